@@ -0,0 +1,169 @@
+package rdialer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AdminAuthorizer 校验管理接口的请求，返回 false 时响应 401
+type AdminAuthorizer func(req *http.Request) bool
+
+// BearerTokenAuthorizer 要求请求携带 "Authorization: Bearer <token>"
+func BearerTokenAuthorizer(token string) AdminAuthorizer {
+	expected := []byte("Bearer " + token)
+	return func(req *http.Request) bool {
+		return token != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) == 1
+	}
+}
+
+// migrateRequest 是迁移客户端接口的请求体
+type migrateRequest struct {
+	URL string `json:"url"`
+}
+
+// kickRequest 是踢出客户端接口的请求体
+type kickRequest struct {
+	Reason     string `json:"reason"`
+	Quarantine string `json:"quarantine,omitempty"` // 隔离时长，如 "10m"
+}
+
+// adminError 是管理接口的错误响应体
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// NewAdminHandler 创建基于 Server 会话管理器的 JSON 管理接口。
+// authorizer 为 nil 时拒绝所有请求，管理接口应监听在与隧道服务不同的地址上。
+//
+//	GET  /clients                        列出已连接客户端
+//	GET  /clients/{clientKey}/sessions   列出客户端的会话
+//	GET  /connections[?clientKey=...]    列出活动的隧道连接
+//	POST /clients/{clientKey}/kick       踢出客户端，请求体 {"reason": "...", "quarantine": "10m"}
+//	DELETE /clients/{clientKey}/quarantine  解除隔离
+//	POST /clients/{clientKey}/migrate    迁移客户端，请求体 {"url": "https://other:8443/connect"}
+//	GET  /clients/{clientKey}/limits     查看客户端限制
+//	PUT  /clients/{clientKey}/limits     修改客户端限制，请求体为 ClientLimits
+func NewAdminHandler(s *Server, authorizer AdminAuthorizer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /clients", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, nonNil(s.Clients()))
+	})
+	mux.HandleFunc("GET /clients/{clientKey}/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Sessions(r.PathValue("clientKey")))
+	})
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, nonNil(s.Connections(r.URL.Query().Get("clientKey"))))
+	})
+	mux.HandleFunc("POST /clients/{clientKey}/kick", func(w http.ResponseWriter, r *http.Request) {
+		var req kickRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+			return
+		}
+		if req.Reason == "" {
+			req.Reason = "kicked by administrator"
+		}
+		var options []DisconnectOption
+		if req.Quarantine != "" {
+			d, err := time.ParseDuration(req.Quarantine)
+			if err != nil || d < 0 {
+				writeJSON(w, http.StatusBadRequest, adminError{"invalid quarantine duration"})
+				return
+			}
+			options = append(options, Quarantine(d))
+		}
+		clientKey := r.PathValue("clientKey")
+		if s.Disconnect(clientKey, req.Reason, options...) == 0 && req.Quarantine == "" {
+			writeJSON(w, http.StatusNotFound, adminError{"client not connected"})
+			return
+		}
+		log.Info().Str("ClientKey", clientKey).Str("Reason", req.Reason).Str("Quarantine", req.Quarantine).
+			Msg("Client kicked by admin")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /clients/{clientKey}/quarantine", func(w http.ResponseWriter, r *http.Request) {
+		s.Release(r.PathValue("clientKey"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /clients/{clientKey}/migrate", func(w http.ResponseWriter, r *http.Request) {
+		var req migrateRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+			return
+		}
+		clientKey := r.PathValue("clientKey")
+		n, err := s.Migrate(clientKey, req.URL)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+			return
+		}
+		if n == 0 {
+			writeJSON(w, http.StatusNotFound, adminError{"no session supports migration"})
+			return
+		}
+		log.Info().Str("ClientKey", clientKey).Str("Target", req.URL).Int("Sessions", n).Msg("Client migration requested by admin")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /clients/{clientKey}/limits", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.ClientLimits(r.PathValue("clientKey")))
+	})
+	mux.HandleFunc("PUT /clients/{clientKey}/limits", func(w http.ResponseWriter, r *http.Request) {
+		var limits ClientLimits
+		if err := decodeJSON(w, r, &limits); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+			return
+		}
+		if limits.MaxSessions < 0 || limits.StreamRate < 0 || limits.StreamBurst < 0 ||
+			limits.MaxStreams < 0 || limits.BytesPerSecond < 0 {
+			writeJSON(w, http.StatusBadRequest, adminError{"limits must not be negative"})
+			return
+		}
+		clientKey := r.PathValue("clientKey")
+		s.SetClientLimits(clientKey, limits)
+		log.Info().Str("ClientKey", clientKey).Interface("Limits", limits).Msg("Client limits updated by admin")
+		writeJSON(w, http.StatusOK, limits)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorizer == nil || !authorizer(r) {
+			writeJSON(w, http.StatusUnauthorized, adminError{errFailedAuth.Error()})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServeAdmin 在独立地址上启动管理接口，阻塞直到监听失败
+func (s *Server) ListenAndServeAdmin(addr string, authorizer AdminAuthorizer) error {
+	log.Info().Msgf("Admin listening on %s", addr)
+	return http.ListenAndServe(addr, NewAdminHandler(s, authorizer))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// decodeJSON 解析请求体，允许空请求体
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// nonNil 使空列表编码为 [] 而不是 null
+func nonNil[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
@@ -1,9 +1,12 @@
 package rdialer
 
 import (
-	"errors"
+	"context"
 	"sync"
 	"time"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/time/rate"
 )
 
 // BackPressure 接口定义了背压控制的基本方法
@@ -14,100 +17,340 @@ type BackPressure interface {
 	Close()
 }
 
-// streamBackPressure 实现了针对单个 WebTransport Stream 的背压控制
+// DefaultStreamBufferBudget 是每个隧道连接每个方向已读取尚未写出的字节数上限，即一个转发缓冲区
+const DefaultStreamBufferBudget = copyBufferSize
+
+// BufferBudget 是隧道连接在目标连接和 WebTransport 流之间缓冲的字节数上限，超出时暂停从较快的一端读取，
+// 直到另一端接收数据或隧道连接因关闭、空闲超时、达到最长存活时间而结束。
+// 每个方向一次最多读取一个转发缓冲区，写入另一端完成之前不再读取
+type BufferBudget struct {
+	PerStream  int `json:"perStream,omitempty"`  // 每个隧道连接每个方向，不大于 0 或超过 DefaultStreamBufferBudget 时为 DefaultStreamBufferBudget
+	PerSession int `json:"perSession,omitempty"` // 每个会话的全部隧道连接，不大于 0 表示不限制
+}
+
+// WithBufferBudget 设置服务端隧道连接的缓冲预算，
+// 未在 QUIC 配置中设置接收窗口时，接收窗口同样不超过设置的预算
+func WithBufferBudget(budget BufferBudget) ServerOption {
+	return func(s *Server) {
+		s.bufferBudget = budget
+	}
+}
+
+// WithClientBufferBudget 设置客户端隧道连接的缓冲预算，接收窗口的处理同 WithBufferBudget
+func WithClientBufferBudget(budget BufferBudget) ClientOption {
+	return func(c *Client) {
+		c.bufferBudget = budget
+	}
+}
+
+// quic-go 默认的初始接收窗口
+const (
+	quicInitialStreamReceiveWindow     = 512 * 1024
+	quicInitialConnectionReceiveWindow = quicInitialStreamReceiveWindow * 3 / 2
+)
+
+// limitReceiveWindows 在显式设置了缓冲预算时使 QUIC 接收窗口不超过预算，对端已发送、本端尚未读取的数据同样受预算限制。
+// 返回 config 的副本，config 中已设置的窗口保持不变
+func limitReceiveWindows(config *quic.Config, budget BufferBudget) *quic.Config {
+	if budget.PerStream <= 0 && budget.PerSession <= 0 {
+		return config
+	}
+	config = config.Clone()
+	if window := uint64(budget.PerStream); budget.PerStream > 0 &&
+		config.InitialStreamReceiveWindow == 0 && config.MaxStreamReceiveWindow == 0 {
+		config.InitialStreamReceiveWindow = min(window, quicInitialStreamReceiveWindow)
+		config.MaxStreamReceiveWindow = window
+	}
+	if window := uint64(budget.PerSession); budget.PerSession > 0 &&
+		config.InitialConnectionReceiveWindow == 0 && config.MaxConnectionReceiveWindow == 0 {
+		config.InitialConnectionReceiveWindow = min(window, quicInitialConnectionReceiveWindow)
+		config.MaxConnectionReceiveWindow = window
+	}
+	return config
+}
+
+// budgetGroup 是共享同一预算的一组流，通常为一个会话，组内的流共用一把锁
+type budgetGroup struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	pending   int // 组内全部流已读取尚未写出的字节数
+	threshold int // 不大于 0 表示不限制
+	perStream int // 组内每个流的上限
+}
+
+func newBudgetGroup(budget BufferBudget) *budgetGroup {
+	g := &budgetGroup{
+		threshold: max(budget.PerSession, 0),
+		perStream: DefaultStreamBufferBudget,
+	}
+	if budget.PerStream > 0 {
+		g.perStream = min(budget.PerStream, DefaultStreamBufferBudget)
+	}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// buffered 返回组内全部流已读取尚未写出的字节数
+func (g *budgetGroup) buffered() int64 {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return int64(g.pending)
+}
+
+// newStream 创建组内一个流方向的背压控制器，组为 nil 时使用不限制会话总量的独立组
+func (g *budgetGroup) newStream() *streamBackPressure {
+	if g == nil {
+		g = newBudgetGroup(BufferBudget{})
+	}
+	return &streamBackPressure{
+		group:          g,
+		threshold:      g.perStream,
+		lastUpdateTime: time.Now(),
+	}
+}
+
+// streamBackPressure 实现了针对单个 WebTransport Stream 一个方向的背压控制，
+// 记录已从一端读取、正在写入另一端的字节数，超出流或所属组的预算时暂停读取
 type streamBackPressure struct {
-	mu             sync.Mutex
-	pendingBytes   int           // 待处理的字节数
-	threshold      int           // 触发背压的阈值
-	waitTimeout    time.Duration // 等待超时时间
+	group          *budgetGroup
+	pendingBytes   int // 待处理的字节数
+	threshold      int // 触发背压的阈值，不大于 0 表示不限制
 	closed         bool
 	lastUpdateTime time.Time
 }
 
-var streamBackPressurePool = sync.Pool{
-	New: func() interface{} {
-		return &streamBackPressure{
-			threshold:      1024 * 1024, // 默认 1MB 阈值
-			waitTimeout:    5 * time.Second,
-			lastUpdateTime: time.Now(),
-		}
-	},
-}
-
-// NewStreamBackPressure 创建一个新的流背压控制器
+// NewStreamBackPressure 创建一个新的流背压控制器，阈值为 DefaultStreamBufferBudget
 func NewStreamBackPressure() BackPressure {
-	bp := streamBackPressurePool.Get().(*streamBackPressure)
-	bp.pendingBytes = 0
-	bp.closed = false
-	bp.lastUpdateTime = time.Now()
-	return bp
+	return (*budgetGroup)(nil).newStream()
 }
 
 // ShouldWait 判断是否需要等待（应用背压）
 func (s *streamBackPressure) ShouldWait() bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.group.mu.Lock()
+	defer s.group.mu.Unlock()
+	return s.shouldWait()
+}
 
+// shouldWait 在持有组锁时判断流或组是否已达到预算
+func (s *streamBackPressure) shouldWait() bool {
 	if s.closed {
 		return false
 	}
-
-	// 如果待处理字节数超过阈值，或者最后更新时间超过一定时间，则应用背压
-	return s.pendingBytes > s.threshold ||
-		time.Since(s.lastUpdateTime) > 2*time.Second
+	return (s.threshold > 0 && s.pendingBytes >= s.threshold) ||
+		(s.group.threshold > 0 && s.group.pending >= s.group.threshold)
 }
 
-// Wait 等待直到可以继续发送数据
+// Wait 等待直到缓冲的字节数回到预算以内或控制器关闭。
+// 另一端长时间不接收数据时不会超时，由隧道连接的空闲超时或最长存活时间关闭连接后返回
 func (s *streamBackPressure) Wait() error {
-	if !s.ShouldWait() {
-		return nil
-	}
-
-	// 简单的等待策略：睡眠一小段时间
-	timer := time.NewTimer(s.waitTimeout)
-	defer timer.Stop()
-
-	start := time.Now()
-	for s.ShouldWait() {
-		if time.Since(start) > s.waitTimeout {
-			return errors.New("背压等待超时")
-		}
-		time.Sleep(10 * time.Millisecond)
+	s.group.mu.Lock()
+	defer s.group.mu.Unlock()
+	for s.shouldWait() {
+		s.group.cond.Wait()
 	}
-
 	return nil
 }
 
-// Update 更新背压状态
+// Update 更新背压状态，正值表示读取后待写出的字节数，负值表示已写出的字节数
 func (s *streamBackPressure) Update(bytesWritten int) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.group.mu.Lock()
+	defer s.group.mu.Unlock()
 
 	if s.closed {
 		return
 	}
-
-	// 更新待处理字节数和最后更新时间
-	s.pendingBytes += bytesWritten
+	// 已写出的字节数不超过待处理的字节数
+	delta := max(bytesWritten, -s.pendingBytes)
+	s.pendingBytes += delta
+	s.group.pending += delta
 	s.lastUpdateTime = time.Now()
+	if delta < 0 {
+		s.group.cond.Broadcast()
+	}
+}
 
-	// 如果确认处理了一些数据，减少待处理字节数
-	if bytesWritten < 0 {
-		s.pendingBytes += bytesWritten // bytesWritten 为负值，表示已处理的字节数
-		if s.pendingBytes < 0 {
-			s.pendingBytes = 0
-		}
+// available 返回在不超出预算的前提下本次最多可以读取的字节数，limit 为上限
+func (s *streamBackPressure) available(limit int) int {
+	s.group.mu.Lock()
+	defer s.group.mu.Unlock()
+	if s.threshold > 0 {
+		limit = min(limit, s.threshold-s.pendingBytes)
+	}
+	if remaining := s.group.threshold - s.group.pending; s.group.threshold > 0 && remaining > 0 {
+		limit = min(limit, remaining)
+	}
+	return max(limit, 1)
+}
+
+// buffered 返回已读取尚未写出的字节数
+func (s *streamBackPressure) buffered() int64 {
+	if s == nil {
+		return 0
 	}
+	s.group.mu.Lock()
+	defer s.group.mu.Unlock()
+	return int64(s.pendingBytes)
 }
 
-// Close 关闭背压控制器并释放资源
+// Close 关闭背压控制器，归还组内占用的预算并唤醒等待者
 func (s *streamBackPressure) Close() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.group.mu.Lock()
+	defer s.group.mu.Unlock()
 
 	if !s.closed {
 		s.closed = true
+		s.group.pending -= s.pendingBytes
 		s.pendingBytes = 0
-		streamBackPressurePool.Put(s)
+		s.group.cond.Broadcast()
 	}
 }
+
+// shapingQuantum 是带宽整形每次等待的最大字节数，也是令牌桶的最小突发量
+const shapingQuantum = 16 * 1024
+
+// BandwidthLimits 是隧道连接的字节速率限制，单位为字节每秒，读写字节数合并计算，不大于 0 表示不限制
+type BandwidthLimits struct {
+	PerConnection int `json:"perConnection,omitempty"` // 每个隧道连接
+	PerClient     int `json:"perClient,omitempty"`     // 每个 clientKey 的全部连接，可由 ClientLimits.BytesPerSecond 覆盖
+	Global        int `json:"global,omitempty"`        // 进程内的全部连接
+}
+
+// WithBandwidthLimit 设置服务端隧道连接的带宽限制，同一客户端的连接公平共享该客户端的带宽
+func WithBandwidthLimit(limits BandwidthLimits) ServerOption {
+	return func(s *Server) {
+		s.sessions.bandwidth = newShapingConfig(limits)
+		s.sessions.bandwidthPerClient = limits.PerClient
+	}
+}
+
+// WithClientBandwidthLimit 设置客户端隧道连接的带宽限制，PerClient 对客户端不生效
+func WithClientBandwidthLimit(limits BandwidthLimits) ClientOption {
+	return func(c *Client) {
+		c.bandwidth = newShapingConfig(limits)
+	}
+}
+
+type bandwidthCtxKey struct{}
+
+// WithDialBandwidth 为单次拨号的隧道连接设置带宽限制，覆盖 BandwidthLimits.PerConnection
+func WithDialBandwidth(ctx context.Context, bytesPerSecond int) context.Context {
+	return context.WithValue(ctx, bandwidthCtxKey{}, bytesPerSecond)
+}
+
+func dialBandwidthFrom(ctx context.Context) int {
+	bytesPerSecond, _ := ctx.Value(bandwidthCtxKey{}).(int)
+	return bytesPerSecond
+}
+
+// shapingConfig 是会话上隧道连接共享的整形设置
+type shapingConfig struct {
+	perConnection int
+	client        *rate.Limiter // 同一 clientKey 的全部会话共享，可为 nil
+	global        *rate.Limiter // 进程内全部会话共享，可为 nil
+}
+
+// shapers 为一个隧道连接创建读写两个方向的整形器，两者共享连接级别的令牌桶。
+// perConnection 大于 0 时覆盖配置的连接级别限制，没有任何限制时返回 nil
+func (cfg shapingConfig) shapers(perConnection int) (read, write *bandwidthShaper) {
+	if perConnection <= 0 {
+		perConnection = cfg.perConnection
+	}
+	var conn *rate.Limiter
+	if perConnection > 0 {
+		conn = newByteLimiter(perConnection)
+	}
+	return newBandwidthShaper(conn, cfg.client, cfg.global), newBandwidthShaper(conn, cfg.client, cfg.global)
+}
+
+func newShapingConfig(limits BandwidthLimits) shapingConfig {
+	cfg := shapingConfig{perConnection: limits.PerConnection}
+	if limits.Global > 0 {
+		cfg.global = newByteLimiter(limits.Global)
+	}
+	return cfg
+}
+
+// newByteLimiter 创建 bytesPerSecond 字节每秒的令牌桶，不大于 0 时不限制
+func newByteLimiter(bytesPerSecond int) *rate.Limiter {
+	limiter := rate.NewLimiter(rate.Inf, shapingQuantum)
+	setByteRate(limiter, bytesPerSecond)
+	return limiter
+}
+
+// setByteRate 调整令牌桶的速率，突发量为 100ms 的配额
+func setByteRate(limiter *rate.Limiter, bytesPerSecond int) {
+	if bytesPerSecond <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	limiter.SetBurst(max(bytesPerSecond/10, shapingQuantum))
+	limiter.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+// bandwidthShaper 是按字节速率限制隧道连接读写的 BackPressure，依次在连接、客户端和全局的令牌桶上等待。
+// 每次最多等待 shapingQuantum 字节，共享同一令牌桶的连接按请求顺序轮流获得配额，
+// 大流量的连接不会挤占同一客户端其他连接的带宽
+type bandwidthShaper struct {
+	mu       sync.Mutex
+	limiters []*rate.Limiter
+	pending  int // 已读写但尚未支付配额的字节数
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// newBandwidthShaper 创建在 limiters 上等待的整形器，忽略 nil 和速率为 rate.Inf 的令牌桶，没有限制时返回 nil
+func newBandwidthShaper(limiters ...*rate.Limiter) *bandwidthShaper {
+	var active []*rate.Limiter
+	for _, limiter := range limiters {
+		if limiter != nil && limiter.Limit() != rate.Inf {
+			active = append(active, limiter)
+		}
+	}
+	if len(active) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &bandwidthShaper{limiters: active, ctx: ctx, cancel: cancel}
+}
+
+// ShouldWait 判断是否有尚未支付配额的字节
+func (b *bandwidthShaper) ShouldWait() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pending > 0 && b.ctx.Err() == nil
+}
+
+// Wait 等待直到尚未支付的字节全部获得配额，整形器关闭后立即返回
+func (b *bandwidthShaper) Wait() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.pending > 0 {
+		quantum := min(b.pending, shapingQuantum)
+		for _, limiter := range b.limiters {
+			if limiter.Limit() == rate.Inf {
+				continue
+			}
+			if err := limiter.WaitN(b.ctx, min(quantum, limiter.Burst())); err != nil {
+				b.pending = 0
+				return err
+			}
+		}
+		b.pending -= quantum
+	}
+	return nil
+}
+
+// Update 记录已读写的字节数
+func (b *bandwidthShaper) Update(bytesWritten int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending += bytesWritten
+}
+
+// Close 关闭整形器，等待中的 Wait 立即返回
+func (b *bandwidthShaper) Close() {
+	b.cancel()
+}
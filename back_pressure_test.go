@@ -0,0 +1,281 @@
+package rdialer
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestShapingConfigShapers(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           shapingConfig
+		perConnection int
+		want          int // 整形器等待的令牌桶数，0 表示不创建整形器
+	}{
+		{name: "no limits", cfg: shapingConfig{}, want: 0},
+		{name: "infinite client limiter", cfg: shapingConfig{client: newByteLimiter(0)}, want: 0},
+		{name: "infinite client and global", cfg: shapingConfig{client: newByteLimiter(0), global: newByteLimiter(0)}, want: 0},
+		{name: "per connection", cfg: shapingConfig{perConnection: 1 << 20}, want: 1},
+		{name: "dial override", cfg: shapingConfig{client: newByteLimiter(0)}, perConnection: 1 << 20, want: 1},
+		{name: "client", cfg: shapingConfig{client: newByteLimiter(1 << 20)}, want: 1},
+		{name: "all", cfg: shapingConfig{perConnection: 1 << 20, client: newByteLimiter(1 << 20), global: newByteLimiter(1 << 20)}, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			read, write := tt.cfg.shapers(tt.perConnection)
+			for _, shaper := range []*bandwidthShaper{read, write} {
+				if tt.want == 0 {
+					if shaper != nil {
+						t.Fatalf("shaper created with limiters %v", shaper.limiters)
+					}
+					continue
+				}
+				if shaper == nil || len(shaper.limiters) != tt.want {
+					t.Fatalf("shaper = %v, want %d limiters", shaper, tt.want)
+				}
+				shaper.Close()
+			}
+		})
+	}
+}
+
+func TestSetByteRate(t *testing.T) {
+	tests := []struct {
+		bytesPerSecond int
+		limit          rate.Limit
+		burst          int
+	}{
+		{bytesPerSecond: 0, limit: rate.Inf, burst: shapingQuantum},
+		{bytesPerSecond: -1, limit: rate.Inf, burst: shapingQuantum},
+		{bytesPerSecond: 1024, limit: 1024, burst: shapingQuantum},
+		{bytesPerSecond: 10 << 20, limit: 10 << 20, burst: 1 << 20},
+	}
+	for _, tt := range tests {
+		limiter := newByteLimiter(tt.bytesPerSecond)
+		if limiter.Limit() != tt.limit || limiter.Burst() != tt.burst {
+			t.Errorf("newByteLimiter(%d) = %v/%d, want %v/%d", tt.bytesPerSecond, limiter.Limit(), limiter.Burst(), tt.limit, tt.burst)
+		}
+	}
+}
+
+// TestBandwidthShaperFairShare 两个连接共享客户端的令牌桶，每次写入 8 个配额单位的连接
+// 与每次写入 1 个配额单位的连接获得的带宽应大致相同
+func TestBandwidthShaperFairShare(t *testing.T) {
+	client := newByteLimiter(4 << 20)
+	client.AllowN(time.Now(), client.Burst())
+	chunks := []int{8 * shapingQuantum, shapingQuantum}
+	shapers := make([]*bandwidthShaper, len(chunks))
+	paid := make([]atomic.Int64, len(chunks))
+	done := make(chan struct{})
+	for i, chunk := range chunks {
+		shapers[i] = newBandwidthShaper(nil, client, nil)
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				shapers[i].Update(chunk)
+				if err := shapers[i].Wait(); err != nil {
+					return
+				}
+				paid[i].Add(int64(chunk))
+			}
+		}()
+	}
+	time.Sleep(500 * time.Millisecond)
+	for _, shaper := range shapers {
+		shaper.Close()
+	}
+	for range shapers {
+		<-done
+	}
+
+	heavy, light := paid[0].Load(), paid[1].Load()
+	total := heavy + light
+	if total == 0 {
+		t.Fatal("no bytes shaped")
+	}
+	if share := float64(light) / float64(total); share < 0.3 || share > 0.7 {
+		t.Fatalf("light connection got %.0f%% of %d bytes (heavy %d, light %d), want a fair share",
+			share*100, total, heavy, light)
+	}
+}
+
+// recordingReader 记录读取的次数和最大的读取长度
+type recordingReader struct {
+	r       io.Reader
+	reads   atomic.Int64
+	maxRead atomic.Int64
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	r.reads.Add(1)
+	if int64(len(p)) > r.maxRead.Load() {
+		r.maxRead.Store(int64(len(p)))
+	}
+	return r.r.Read(p)
+}
+
+// waitFor 轮询 cond 直到返回 true，超时后测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCopyBufferReadSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		perStream int
+		want      int64
+	}{
+		{name: "default", want: DefaultStreamBufferBudget},
+		{name: "smaller budget", perStream: 4096, want: 4096},
+		{name: "larger budget", perStream: 1 << 20, want: DefaultStreamBufferBudget},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bp := newBudgetGroup(BufferBudget{PerStream: tt.perStream}).newStream()
+			src := &recordingReader{r: &io.LimitedReader{R: zeroReader{}, N: 1 << 20}}
+			if n, err := copyBuffer(discardWriter{}, src, bp); err != nil || n != 1<<20 {
+				t.Fatalf("copied %d bytes: %v", n, err)
+			}
+			if got := src.maxRead.Load(); got != tt.want {
+				t.Fatalf("largest read = %d, want %d", got, tt.want)
+			}
+			if n := bp.buffered(); n != 0 {
+				t.Fatalf("buffered %d bytes after copy", n)
+			}
+		})
+	}
+}
+
+func TestCopyBufferSessionBudget(t *testing.T) {
+	const budget = 16 * 1024
+	tests := []struct {
+		name    string
+		release func(stalledR *io.PipeReader, waiting *streamBackPressure)
+	}{
+		// 阻塞的写入完成后，归还的预算让等待的流继续读取
+		{name: "stalled writer drains", release: func(stalledR *io.PipeReader, _ *streamBackPressure) {
+			go func() { _, _ = io.Copy(io.Discard, stalledR) }()
+		}},
+		// 隧道连接关闭时关闭控制器，等待中的流立即返回
+		{name: "waiting stream closed", release: func(_ *io.PipeReader, waiting *streamBackPressure) {
+			waiting.Close()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := newBudgetGroup(BufferBudget{PerSession: budget})
+			stalled, waiting := group.newStream(), group.newStream()
+
+			// 第一个流读取整个会话预算后阻塞在写入上
+			stalledR, stalledW := io.Pipe()
+			defer stalledR.Close()
+			stalledDone := make(chan error, 1)
+			go func() {
+				_, err := copyBuffer(stalledW, &io.LimitedReader{R: zeroReader{}, N: budget}, stalled)
+				stalledDone <- err
+			}()
+			waitFor(t, "session budget used", func() bool { return group.buffered() == budget })
+
+			// 会话预算用尽，第二个流不读取数据
+			src := &recordingReader{r: &io.LimitedReader{R: zeroReader{}, N: budget}}
+			waitingDone := make(chan error, 1)
+			go func() {
+				_, err := copyBuffer(discardWriter{}, src, waiting)
+				waitingDone <- err
+			}()
+			time.Sleep(50 * time.Millisecond)
+			if n := src.reads.Load(); n != 0 {
+				t.Fatalf("stream read %d times while the session was over budget", n)
+			}
+
+			tt.release(stalledR, waiting)
+			select {
+			case err := <-waitingDone:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("waiting stream did not resume")
+			}
+			_ = stalledR.Close()
+			<-stalledDone
+			stalled.Close()
+			if n := group.buffered(); n != 0 {
+				t.Fatalf("session buffered %d bytes after both streams ended", n)
+			}
+		})
+	}
+}
+
+func TestPipeStalledPeer(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts TunnelTimeouts
+		want     closeReason
+	}{
+		// 对端长时间不接收数据时暂停读取，不关闭隧道连接
+		{name: "no idle timeout", timeouts: TunnelTimeouts{IdleTimeout: NoTimeout}},
+		{name: "idle timeout", timeouts: TunnelTimeouts{IdleTimeout: 200 * time.Millisecond}, want: closeIdle},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel, app := newPipeConnection()
+			dialed, target := net.Pipe()
+			defer target.Close()
+			var sent atomic.Int64
+			go func() {
+				buf := make([]byte, 4096)
+				for {
+					n, err := app.Write(buf)
+					sent.Add(int64(n))
+					if err != nil {
+						return
+					}
+				}
+			}()
+			done := make(chan closeReason, 1)
+			go func() {
+				done <- pipe(tunnel, dialed, tt.timeouts)
+			}()
+
+			select {
+			case reason := <-done:
+				if tt.want == "" {
+					t.Fatalf("pipe closed with %q while the peer was paused", reason)
+				}
+				if reason != tt.want {
+					t.Fatalf("close reason = %q, want %q", reason, tt.want)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if tt.want != "" {
+					t.Fatal("pipe did not close")
+				}
+				if n := tunnel.inBudget.buffered(); n > DefaultStreamBufferBudget {
+					t.Fatalf("buffered %d bytes, budget %d", n, DefaultStreamBufferBudget)
+				}
+				if n := sent.Load(); n > DefaultStreamBufferBudget {
+					t.Fatalf("read %d bytes from the tunnel while the target was paused", n)
+				}
+				// 对端恢复接收后继续转发，数据写完后正常关闭
+				go func() { _, _ = io.Copy(io.Discard, target) }()
+				waitFor(t, "forwarding resumed", func() bool { return sent.Load() > DefaultStreamBufferBudget })
+				_ = app.Close()
+				if reason := <-done; reason != closeNormal {
+					t.Fatalf("close reason = %q, want %q", reason, closeNormal)
+				}
+			}
+		})
+	}
+}
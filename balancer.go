@@ -0,0 +1,106 @@
+package rdialer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/rand"
+)
+
+// Candidate 是负载均衡器可见的会话视图
+type Candidate interface {
+	// ID 返回会话在服务端内唯一的标识
+	ID() int64
+	// ActiveStreams 返回会话当前活动的流数量
+	ActiveStreams() int64
+	// RTT 返回最近一次心跳测得的往返时延，未测量时为 0
+	RTT() time.Duration
+	// Weight 返回客户端声明的权重，默认为 1
+	Weight() int
+}
+
+// Balancer 在同一 clientKey 的多个会话中选择一个用于拨号
+type Balancer interface {
+	// Pick 从非空的 candidates 中选择一个会话
+	Pick(clientKey string, candidates []Candidate) Candidate
+}
+
+// BalancerFunc 允许使用普通函数作为 Balancer
+type BalancerFunc func(clientKey string, candidates []Candidate) Candidate
+
+func (f BalancerFunc) Pick(clientKey string, candidates []Candidate) Candidate {
+	return f(clientKey, candidates)
+}
+
+// RandomBalancer 随机选择会话
+func RandomBalancer() Balancer {
+	return BalancerFunc(func(_ string, candidates []Candidate) Candidate {
+		return candidates[rand.Intn(len(candidates))]
+	})
+}
+
+// RoundRobinBalancer 按 clientKey 轮询选择会话
+func RoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{}
+}
+
+type roundRobinBalancer struct {
+	counters sync.Map // map[string]*atomic.Uint64
+}
+
+func (b *roundRobinBalancer) Pick(clientKey string, candidates []Candidate) Candidate {
+	value, _ := b.counters.LoadOrStore(clientKey, &atomic.Uint64{})
+	n := value.(*atomic.Uint64).Add(1)
+	return candidates[n%uint64(len(candidates))]
+}
+
+// LeastStreamsBalancer 选择活动流最少的会话
+func LeastStreamsBalancer() Balancer {
+	return BalancerFunc(func(_ string, candidates []Candidate) Candidate {
+		selected := candidates[0]
+		for _, c := range candidates[1:] {
+			if c.ActiveStreams() < selected.ActiveStreams() {
+				selected = c
+			}
+		}
+		return selected
+	})
+}
+
+// LowestRTTBalancer 选择往返时延最低的会话，尚未测得时延的会话按活动流数量比较
+func LowestRTTBalancer() Balancer {
+	return BalancerFunc(func(_ string, candidates []Candidate) Candidate {
+		selected := candidates[0]
+		for _, c := range candidates[1:] {
+			rtt, best := c.RTT(), selected.RTT()
+			switch {
+			case rtt > 0 && (best == 0 || rtt < best):
+				selected = c
+			case rtt == best && c.ActiveStreams() < selected.ActiveStreams():
+				selected = c
+			}
+		}
+		return selected
+	})
+}
+
+// WeightedBalancer 按客户端声明的权重随机选择会话
+func WeightedBalancer() Balancer {
+	return BalancerFunc(func(_ string, candidates []Candidate) Candidate {
+		total := 0
+		for _, c := range candidates {
+			total += max(c.Weight(), 0)
+		}
+		if total == 0 {
+			return candidates[rand.Intn(len(candidates))]
+		}
+		n := rand.Intn(total)
+		for _, c := range candidates {
+			if n -= max(c.Weight(), 0); n < 0 {
+				return c
+			}
+		}
+		return candidates[len(candidates)-1]
+	})
+}
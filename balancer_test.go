@@ -0,0 +1,107 @@
+package rdialer
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeCandidate 是测试用的 Candidate
+type fakeCandidate struct {
+	id      int64
+	streams int64
+	rtt     time.Duration
+	weight  int
+}
+
+func (c fakeCandidate) ID() int64            { return c.id }
+func (c fakeCandidate) ActiveStreams() int64 { return c.streams }
+func (c fakeCandidate) RTT() time.Duration   { return c.rtt }
+func (c fakeCandidate) Weight() int          { return c.weight }
+
+func TestBalancers(t *testing.T) {
+	tests := []struct {
+		name       string
+		balancer   Balancer
+		candidates []fakeCandidate
+		want       int64 // 期望选中的会话 ID
+	}{
+		{name: "least streams", balancer: LeastStreamsBalancer(),
+			candidates: []fakeCandidate{{id: 1, streams: 5}, {id: 2, streams: 1}, {id: 3, streams: 3}}, want: 2},
+		{name: "least streams tie keeps first", balancer: LeastStreamsBalancer(),
+			candidates: []fakeCandidate{{id: 1, streams: 2}, {id: 2, streams: 2}}, want: 1},
+		{name: "lowest rtt", balancer: LowestRTTBalancer(),
+			candidates: []fakeCandidate{{id: 1, rtt: 30 * time.Millisecond}, {id: 2, rtt: 10 * time.Millisecond}, {id: 3, rtt: 20 * time.Millisecond}}, want: 2},
+		{name: "lowest rtt prefers measured", balancer: LowestRTTBalancer(),
+			candidates: []fakeCandidate{{id: 1}, {id: 2, rtt: 50 * time.Millisecond}}, want: 2},
+		{name: "lowest rtt unmeasured by streams", balancer: LowestRTTBalancer(),
+			candidates: []fakeCandidate{{id: 1, streams: 4}, {id: 2, streams: 1}}, want: 2},
+		{name: "weighted skips zero weight", balancer: WeightedBalancer(),
+			candidates: []fakeCandidate{{id: 1, weight: 0}, {id: 2, weight: 3}, {id: 3, weight: -1}}, want: 2},
+		{name: "random single", balancer: RandomBalancer(),
+			candidates: []fakeCandidate{{id: 7}}, want: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates := make([]Candidate, len(tt.candidates))
+			for i, c := range tt.candidates {
+				candidates[i] = c
+			}
+			for i := 0; i < 10; i++ {
+				if got := tt.balancer.Pick("k", candidates).ID(); got != tt.want {
+					t.Fatalf("Pick = %d, want %d", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	b := RoundRobinBalancer()
+	candidates := []Candidate{fakeCandidate{id: 1}, fakeCandidate{id: 2}, fakeCandidate{id: 3}}
+	seen := make(map[int64]int)
+	for i := 0; i < 9; i++ {
+		seen[b.Pick("a", candidates).ID()]++
+	}
+	for _, c := range candidates {
+		if seen[c.ID()] != 3 {
+			t.Fatalf("picks = %v, want 3 each", seen)
+		}
+	}
+	// 不同 clientKey 的计数相互独立
+	first := b.Pick("b", candidates).ID()
+	if second := b.Pick("b", candidates).ID(); second == first {
+		t.Fatalf("consecutive picks for a new client both chose %d", first)
+	}
+}
+
+func TestPickCandidate(t *testing.T) {
+	sessions := []*serverSession{{id: 1}, {id: 2}}
+	candidates := []Candidate{sessions[0], sessions[1]}
+	tests := []struct {
+		name     string
+		balancer BalancerFunc
+		want     *serverSession // nil 表示返回错误
+	}{
+		{name: "candidate", balancer: func(_ string, c []Candidate) Candidate { return c[1] }, want: sessions[1]},
+		// 包装候选会话的策略按 ID 映射回会话
+		{name: "wrapped candidate", balancer: func(_ string, c []Candidate) Candidate {
+			return fakeCandidate{id: c[0].ID()}
+		}, want: sessions[0]},
+		{name: "nil", balancer: func(string, []Candidate) Candidate { return nil }},
+		{name: "unknown id", balancer: func(string, []Candidate) Candidate { return fakeCandidate{id: 3} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pickCandidate(tt.balancer, "k", candidates)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("pickCandidate = session %d, want error", got.id)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("pickCandidate = %v, %v, want session %d", got, err, tt.want.id)
+			}
+		})
+	}
+}
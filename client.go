@@ -2,48 +2,510 @@ package rdialer
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/midy177/webtransport-go"
 	"github.com/quic-go/quic-go"
 	"github.com/rs/zerolog/log"
+	"io"
+	"maps"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	errNoEndpoint = errors.New("no server endpoint available")
+)
+
 // Client 表示一个 WebTransport 客户端
 type Client struct {
-	serverURL *url.URL
-	session   *webtransport.Session
+	serverURLs    []*url.URL
+	extraServers  []string
+	resolveDNS    bool
+	redundancy    int
+	parallel      int
+	retryInterval time.Duration
+	weight        int
+	labels        map[string]string
+	group         string
+	priority      int
+	instanceID    string // 客户端实例标识，服务端据此替换同一槽位遗留的旧会话
+	reauth        func(ctx context.Context) (http.Header, error)
+	keepalive     keepaliveConfig
+	timeouts      TunnelTimeouts
+	concurrency   concurrencyLimits
+	bandwidth     shapingConfig
+	bufferBudget  BufferBudget
+
+	mu       sync.Mutex
+	health   map[string]*endpointHealth // 以拨号地址为键的服务端健康状况
+	pending  map[string]int             // 以拨号地址为键的正在建立中的会话数
+	sessions []*clientSession           // 当前存活的会话，按建立顺序排列
+	next     uint64                     // 本地拨号轮询计数
+	draining atomic.Int32               // 收到 GOAWAY 后仍在等待服务端关闭的会话数
+	cancel   context.CancelFunc
+
+	controlHandlers []func(msg ControlMessage)
+}
+
+// ClientOption 定义客户端配置选项
+type ClientOption func(*Client)
+
+// WithServers 追加备用服务端地址，按给定顺序作为故障转移候选
+func WithServers(serverAddrs ...string) ClientOption {
+	return func(c *Client) {
+		c.extraServers = append(c.extraServers, serverAddrs...)
+	}
+}
+
+// WithDNSResolve 连接时将服务端域名展开为全部 A/AAAA 记录，每个地址作为独立的候选端点
+func WithDNSResolve() ClientOption {
+	return func(c *Client) {
+		c.resolveDNS = true
+	}
+}
+
+// WithRedundancy 设置同时保持连接的服务端数量，例如 2 表示同时与两个不同的服务端保持会话
+func WithRedundancy(n int) ClientOption {
+	return func(c *Client) {
+		c.redundancy = n
+	}
+}
+
+// WithParallelSessions 设置与每个服务端同时保持的会话数，
+// 多个 QUIC 连接可以突破单连接的吞吐和拥塞窗口限制
+func WithParallelSessions(n int) ClientOption {
+	return func(c *Client) {
+		c.parallel = n
+	}
+}
+
+// WithWeight 设置客户端的权重，服务端使用 WeightedBalancer 时按权重分配流量
+func WithWeight(weight int) ClientOption {
+	return func(c *Client) {
+		c.weight = weight
+	}
+}
+
+// WithLabels 设置客户端在握手中声明的标签，服务端可据此按选择器拨号
+func WithLabels(labels map[string]string) ClientOption {
+	return func(c *Client) {
+		c.labels = maps.Clone(labels)
+	}
+}
+
+// WithGroup 声明客户端所属的组及组内优先级，服务端的组拨号器优先使用优先级最高（数值最大）的成员。
+// 服务端设置了认证函数时由认证方决定是否采用声明的值，见 Identity.Group
+func WithGroup(group string, priority int) ClientOption {
+	return func(c *Client) {
+		c.group = group
+		c.priority = priority
+	}
+}
+
+// WithRetryInterval 设置在仍有其他会话存活时，重新尝试建立冗余会话的间隔
+func WithRetryInterval(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.retryInterval = d
+	}
+}
+
+// endpoint 表示一个可拨号的服务端端点
+type endpoint struct {
+	url      *url.URL
+	dialAddr string // 实际拨号的 host:port，DNS 展开后为 IP 地址
+}
+
+// endpointHealth 记录端点的健康状况，用于选择最健康的服务端
+type endpointHealth struct {
+	failures int           // 连续失败次数
+	latency  time.Duration // 最近一次建立会话的耗时
+}
+
+// clientSession 表示客户端与某个服务端之间的一个会话
+type clientSession struct {
+	endpoint      endpoint
+	session       *webtransport.Session
+	serverVersion int          // 服务端在握手响应中声明的协议版本
+	rtt           atomic.Int64 // 旧版本保活测得的往返时延（纳秒），使用控制通道时以控制通道为准
+	stats         streamStats
+	header        http.Header // 建立会话时使用的请求头，迁移时沿用
+	goAway        *goAwayState
+	draining      atomic.Bool                    // 收到 GOAWAY 或已迁移，不再承接新的拨号
+	control       atomic.Pointer[controlChannel] // 服务端不支持控制通道时为 nil
 }
 
 // NewClient 创建一个新的 WebTransport 客户端
-func NewClient(serverAddr string) (*Client, error) {
-	serverURL, err := url.Parse(serverAddr)
-	if err != nil {
-		return nil, fmt.Errorf("FailedTo resolve server address: %w", err)
+func NewClient(serverAddr string, options ...ClientOption) (*Client, error) {
+	c := &Client{
+		health:  make(map[string]*endpointHealth),
+		pending: make(map[string]int),
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("generate instance id: %w", err)
+	}
+	c.instanceID = hex.EncodeToString(id)
+	for _, opt := range options {
+		opt(c)
 	}
 
-	// 确保使用 HTTPS 协议
-	if serverURL.Scheme != "https" {
-		return nil, fmt.Errorf("WebTransport Require HTTPS protocol")
+	for _, addr := range append([]string{serverAddr}, c.extraServers...) {
+		serverURL, err := url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("FailedTo resolve server address: %w", err)
+		}
+
+		// 确保使用 HTTPS 协议
+		if serverURL.Scheme != "https" {
+			return nil, fmt.Errorf("WebTransport Require HTTPS protocol")
+		}
+		c.serverURLs = append(c.serverURLs, serverURL)
 	}
 
-	return &Client{
-		serverURL: serverURL,
-	}, nil
+	if c.redundancy <= 0 {
+		c.redundancy = 1
+	}
+	if c.parallel <= 0 {
+		c.parallel = 1
+	}
+	if c.retryInterval <= 0 {
+		c.retryInterval = 10 * time.Second
+	}
+	c.keepalive = c.keepalive.withDefaults()
+
+	return c, nil
 }
 
-// Connect 连接到 WebTransport 服务器
+// Connect 连接到 WebTransport 服务器，并阻塞直到所有会话都断开且无法故障转移到其他服务端
 func (c *Client) Connect(ctx context.Context, header http.Header) error {
-	if c.session != nil {
+	c.mu.Lock()
+	if c.cancel != nil {
+		c.mu.Unlock()
 		return nil // 已经连接
 	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+	c.mu.Unlock()
+
+	// 每个服务端 parallel 个会话，共 redundancy 个服务端
+	slots := c.redundancy * c.parallel
+	errCh := make(chan error, slots)
+	for i := 0; i < slots; i++ {
+		go func(slot int) {
+			errCh <- c.maintain(ctx, header, slot)
+		}(i)
+	}
+
+	var err error
+	for i := 0; i < slots; i++ {
+		if e := <-errCh; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	cancel()
+	c.mu.Lock()
+	c.cancel = nil
+	c.mu.Unlock()
+	return err
+}
+
+// Close 关闭客户端连接
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	sessions := c.sessions
+	c.sessions = nil
+	c.mu.Unlock()
+
+	var err error
+	for _, cs := range sessions {
+		if e := cs.session.CloseWithError(0, "Client actively closes"); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// GetDialer 打开一个OpenDialer，拨号器在每次拨号时重新选择会话，客户端重连后仍然可用
+func (c *Client) GetDialer() (Dialer, error) {
+	return c.GetPrefixDialer("")
+}
+
+func (c *Client) GetPrefixDialer(prefix string) (Dialer, error) {
+	if c.primarySession(nil) == nil {
+		return nil, fmt.Errorf("Session is nil")
+	}
+	return liveDialer(c.pickSession, prefix, c.timeouts), nil
+}
+
+func (c *Client) pickSession(_ context.Context, exclude map[*webtransport.Session]bool) (*webtransport.Session, *streamStats, int, error) {
+	cs := c.primarySession(exclude)
+	if cs == nil {
+		return nil, nil, 0, fmt.Errorf("Session is nil")
+	}
+	return cs.session, &cs.stats, cs.serverVersion, nil
+}
+
+// primarySession 返回主服务端（最早建立且仍然存活的会话所在端点）的会话，
+// 主服务端有多个并行会话时轮询选择，exclude 中的会话被跳过
+func (c *Client) primarySession(exclude map[*webtransport.Session]bool) *clientSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var candidates []*clientSession
+	for _, cs := range c.sessions {
+		if exclude[cs.session] || cs.session.Context().Err() != nil || cs.draining.Load() {
+			continue
+		}
+		if len(candidates) > 0 && cs.endpoint.dialAddr != candidates[0].endpoint.dialAddr {
+			continue
+		}
+		candidates = append(candidates, cs)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	c.next++
+	return candidates[c.next%uint64(len(candidates))]
+}
+
+// maintain 维持一个会话槽位：会话断开后立即故障转移到下一个最健康的服务端。
+// 当所有端点都不可达且客户端已没有任何存活会话时返回错误。
+func (c *Client) maintain(ctx context.Context, header http.Header, slot int) error {
+	header = header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set(instanceHeader, fmt.Sprintf("%s-%d", c.instanceID, slot))
+	header.Set(versionHeader, strconv.Itoa(ProtocolVersion))
+	if c.weight > 0 {
+		header.Set(weightHeader, strconv.Itoa(c.weight))
+	}
+	if c.group != "" {
+		header.Set(groupHeader, c.group)
+		header.Set(priorityHeader, strconv.Itoa(c.priority))
+	}
+	var next *clientSession // 迁移后已建立的新会话
+	for {
+		cs := next
+		next = nil
+		if cs == nil {
+			c.setLabelsHeader(header)
+			var err error
+			cs, err = c.connectBest(ctx, header)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				if c.liveSessions() == 0 && c.draining.Load() == 0 {
+					return err
+				}
+				// 其他槽位仍有存活会话，稍后再尝试恢复冗余
+				log.Debug().Err(err).Msg("redundant session unavailable, retry later")
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(c.retryInterval):
+				}
+				continue
+			}
+		}
+
+		err := c.serve(ctx, cs)
+		c.removeSession(cs)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var migrated *migratedError
+		if errors.As(err, &migrated) {
+			log.Info().Str("Server", cs.endpoint.url.String()).Str("Target", migrated.target).Msg("session migrated")
+			next = migrated.next
+			continue
+		}
+		log.Warn().Str("Server", cs.endpoint.url.String()).Str("DialAddr", cs.endpoint.dialAddr).
+			Err(err).Msg("session lost, failing over")
+	}
+}
+
+// setLabelsHeader 将客户端当前的标签写入握手请求头
+func (c *Client) setLabelsHeader(header http.Header) {
+	c.mu.Lock()
+	labels := formatLabels(c.labels)
+	c.mu.Unlock()
+	if labels == "" {
+		header.Del(labelsHeader)
+		return
+	}
+	header.Set(labelsHeader, labels)
+}
+
+// connectBest 按健康状况依次尝试候选端点，跳过并行会话数已满的端点
+func (c *Client) connectBest(ctx context.Context, header http.Header) (*clientSession, error) {
+	endpoints, err := c.resolveEndpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error = errNoEndpoint
+	for _, ep := range c.rankEndpoints(endpoints) {
+		if !c.reserve(ep) {
+			continue
+		}
+		start := time.Now()
+		session, version, err := c.dial(ctx, ep, header)
+		c.recordResult(ep, time.Since(start), err)
+		if err != nil {
+			c.release(ep, nil)
+			log.Warn().Str("Server", ep.url.String()).Str("DialAddr", ep.dialAddr).Err(err).Msg("connect to server failed")
+			lastErr = err
+			continue
+		}
+		cs := c.newClientSession(ep, session, version, header.Clone())
+		c.release(ep, cs)
+		return cs, nil
+	}
+	return nil, lastErr
+}
+
+// resolveEndpoints 生成候选端点列表，开启 DNS 展开时每个 A/AAAA 记录对应一个端点
+func (c *Client) resolveEndpoints(ctx context.Context) ([]endpoint, error) {
+	var endpoints []endpoint
+	for _, u := range c.serverURLs {
+		if !c.resolveDNS || net.ParseIP(u.Hostname()) != nil {
+			endpoints = append(endpoints, endpoint{url: u, dialAddr: u.Host})
+			continue
+		}
+		port := u.Port()
+		if port == "" {
+			port = "443"
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+		if err != nil {
+			log.Warn().Str("Host", u.Hostname()).Err(err).Msg("resolve server address failed")
+			continue
+		}
+		for _, ip := range addrs {
+			endpoints = append(endpoints, endpoint{url: u, dialAddr: net.JoinHostPort(ip.String(), port)})
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, errNoEndpoint
+	}
+	return endpoints, nil
+}
+
+// rankEndpoints 按连续失败次数、建连耗时排序，相同情况下保持配置顺序
+func (c *Client) rankEndpoints(endpoints []endpoint) []endpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ranked := append([]endpoint(nil), endpoints...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		hi, hj := c.healthOf(ranked[i]), c.healthOf(ranked[j])
+		if hi.failures != hj.failures {
+			return hi.failures < hj.failures
+		}
+		return hi.latency < hj.latency
+	})
+	return ranked
+}
+
+// healthOf 返回端点的健康状况，未尝试过的端点视为健康
+func (c *Client) healthOf(ep endpoint) endpointHealth {
+	if h, ok := c.health[ep.dialAddr]; ok {
+		return *h
+	}
+	return endpointHealth{}
+}
+
+func (c *Client) recordResult(ep endpoint, latency time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.health[ep.dialAddr]
+	if !ok {
+		h = &endpointHealth{}
+		c.health[ep.dialAddr] = h
+	}
+	if err != nil {
+		h.failures++
+		return
+	}
+	h.failures = 0
+	h.latency = latency
+}
+
+// reserve 在端点的存活和建立中会话数未达到 parallel 时占用一个名额
+func (c *Client) reserve(ep endpoint) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.pending[ep.dialAddr]
+	for _, cs := range c.sessions {
+		if cs.endpoint.dialAddr == ep.dialAddr {
+			n++
+		}
+	}
+	if n >= c.parallel {
+		return false
+	}
+	c.pending[ep.dialAddr]++
+	return true
+}
+
+// release 归还 reserve 占用的名额，会话建立成功时同时将其加入存活列表
+func (c *Client) release(ep endpoint, cs *clientSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cs != nil {
+		c.sessions = append(c.sessions, cs)
+	}
+	if c.pending[ep.dialAddr]--; c.pending[ep.dialAddr] <= 0 {
+		delete(c.pending, ep.dialAddr)
+	}
+}
+
+func (c *Client) liveSessions() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sessions)
+}
+
+func (c *Client) removeSession(cs *clientSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, s := range c.sessions {
+		if s == cs {
+			c.sessions = append(c.sessions[:i], c.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// newClientSession 创建新建立的会话，会话加入存活列表前完成隧道连接的设置
+func (c *Client) newClientSession(ep endpoint, session *webtransport.Session, version int, header http.Header) *clientSession {
+	cs := &clientSession{endpoint: ep, session: session, serverVersion: version, header: header, goAway: newGoAwayState()}
+	cs.stats.shaping = c.bandwidth
+	cs.stats.budget = newBudgetGroup(c.bufferBudget)
+	return cs
+}
+
+// dial 与单个端点建立 WebTransport 会话，同时返回服务端声明的协议版本
+func (c *Client) dial(ctx context.Context, ep endpoint, header http.Header) (*webtransport.Session, int, error) {
 	// 配置 TLS
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: true, // 注意：生产环境应该使用有效证书
 		NextProtos:         []string{"h3"},
+		ServerName:         ep.url.Hostname(),
 	}
 
 	// 配置 QUIC
@@ -51,64 +513,121 @@ func (c *Client) Connect(ctx context.Context, header http.Header) error {
 		MaxIncomingStreams: 100000, // 允许最多10000个并发双向流
 		EnableDatagrams:    true,   // 启用数据报支持
 	}
+	quicConfig = limitReceiveWindows(quicConfig, c.bufferBudget)
 
 	// 创建 WebTransport 拨号器
 	dialer := &webtransport.Dialer{
 		TLSClientConfig: tlsConfig,
 		QUICConfig:      quicConfig,
+		DialAddr: func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			return quic.DialAddrEarly(ctx, ep.dialAddr, tlsCfg, cfg)
+		},
 	}
 
 	// 使用拨号器创建 WebTransport 会话
-	resp, session, err := dialer.Dial(ctx, c.serverURL.String(), header)
+	resp, session, err := dialer.Dial(ctx, ep.url.String(), header.Clone())
 	if err != nil {
-		return fmt.Errorf("WebTransport Connection failed: %w", err)
+		if resp != nil && resp.StatusCode == StatusQuarantined {
+			retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			return nil, 0, &QuarantinedError{RetryAfter: time.Duration(retryAfter) * time.Second}
+		}
+		return nil, 0, fmt.Errorf("WebTransport Connection failed: %w", err)
 	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("ConnectionRefused, status code: %d", resp.StatusCode)
+		return nil, 0, fmt.Errorf("ConnectionRefused, status code: %d", resp.StatusCode)
 	}
-	go handleSession("local", session)
+	version, _ := strconv.Atoi(resp.Header.Get(versionHeader))
+	return session, version, nil
+}
+
+// serve 运行会话的流处理和心跳，直到会话断开
+func (c *Client) serve(ctx context.Context, cs *clientSession) error {
+	session := cs.session
+	stop := context.AfterFunc(ctx, func() {
+		_ = session.CloseWithError(0, "Client actively closes")
+	})
+	handlers := map[MessageType]messageHandler{
+		GoAway: cs.goAway.handler(session.RemoteAddr().String()),
+	}
+	go handleSession("local", session, &cs.stats, newSessionLimiter(), c.concurrency, c.timeouts, handlers)
 	stream, err := session.OpenStream()
 	if err != nil {
+		stop()
 		return fmt.Errorf("OpenStream failed: %w", err)
 	}
-	_, err = SendKeepAliveMessage(stream)
-	if err != nil {
-		return fmt.Errorf("SendKeepAliveMessage failed: %w", err)
+	done := make(chan error, 1)
+	migrate := make(chan string, 1)
+	if cs.serverVersion >= controlVersion {
+		if _, err = NewEncodeBuffer(Control, nil).WriteTo(stream); err != nil {
+			stop()
+			return fmt.Errorf("open control channel failed: %w", err)
+		}
+		cc := newControlChannel(stream, c.keepalive)
+		cs.control.Store(cc)
+		go func() {
+			done <- c.runControl(ctx, cs, cc, migrate)
+		}()
+	} else {
+		// 旧版本服务端不支持控制通道，使用单字节回显保活
+		if _, err = SendKeepAliveMessage(stream); err != nil {
+			stop()
+			return fmt.Errorf("SendKeepAliveMessage failed: %w", err)
+		}
+		go func() {
+			done <- c.legacyKeepalive(cs, stream, migrate)
+		}()
 	}
-	c.session = session
-	return c.keepalive(stream)
-}
-
-// Close 关闭客户端连接
-func (c *Client) Close() error {
-	var err error
-	if c.session != nil {
-		err = c.session.CloseWithError(0, "Client actively closes")
-		c.session = nil
+	for {
+		select {
+		case err = <-done:
+		case <-cs.goAway.ch:
+			// 停止保活并让出槽位重连，旧会话上进行中的隧道连接结束后关闭
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			c.drain(cs, "server sent GOAWAY", stop)
+			return errGoAway
+		case target := <-migrate:
+			// 先建立新会话再停止使用旧会话，保证迁移期间始终有可用的会话
+			next, err := c.migrate(ctx, cs, target)
+			if err != nil {
+				log.Warn().Str("Target", target).Err(err).Msg("migration failed, keep current session")
+				continue
+			}
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			c.drain(cs, "migrated to "+target, stop)
+			return &migratedError{target: target, next: next}
+		}
+		break
 	}
-	return err
-}
-
-// GetDialer 打开一个OpenDialer
-func (c *Client) GetDialer() (Dialer, error) {
-	if c.session == nil {
-		return nil, fmt.Errorf("Session is nil")
+	stop()
+	// 保活失败时会话可能仍在关闭中，稍等片刻以读取服务端给出的关闭原因
+	select {
+	case <-session.Context().Done():
+	case <-time.After(time.Second):
 	}
-	return toDialer(c.session, ""), nil
-}
-
-func (c *Client) GetPrefixDialer(prefix string) (Dialer, error) {
-	return toDialer(c.session, prefix), nil
+	if closeErr := sessionCloseError(session); closeErr != nil && closeErr.Remote {
+		log.Warn().Str("RemoteAddr", session.RemoteAddr().String()).Uint32("Code", uint32(closeErr.ErrorCode)).
+			Str("Reason", closeErr.Message).Msg("session closed by server")
+		return closeErr
+	}
+	return err
 }
 
-func (c *Client) keepalive(stream webtransport.Stream) error {
-	remoteAddr := c.session.RemoteAddr()
-	localAddr := c.session.LocalAddr()
+// legacyKeepalive 按保活间隔发送保活字节并读取应答，应答携带的迁移目标发送到 migrate，
+// 超过失效阈值未收到应答时关闭会话
+func (c *Client) legacyKeepalive(cs *clientSession, stream webtransport.Stream, migrate chan<- string) error {
+	session := cs.session
+	remoteAddr := session.RemoteAddr()
+	localAddr := session.LocalAddr()
 	streamID := stream.StreamID()
 	log.Info().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Msg("Successfully connected to rdialer")
 	keepMsg := make([]byte, 1)
 	for {
-		time.Sleep(time.Second * 3)
+		time.Sleep(c.keepalive.interval)
+		keepMsg[0] = keepaliveEcho
+		sentAt := time.Now()
+		_ = stream.SetReadDeadline(sentAt.Add(c.keepalive.timeout(c.keepalive.interval)))
 		_, err := stream.Write(keepMsg)
 		if err != nil {
 			log.Error().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Err(err).Msg("write keepalive")
@@ -116,11 +635,30 @@ func (c *Client) keepalive(stream webtransport.Stream) error {
 		}
 		log.Debug().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).
 			Int64("StreamID", int64(streamID)).Str("Role", "client").Msg("send keepalive")
-		_, err = stream.Read(keepMsg)
+		_, err = io.ReadFull(stream, keepMsg)
+		if isTimeout(err) {
+			log.Warn().Str("RemoteAddr", remoteAddr.String()).Msg("keepalive timeout, closing session")
+			_ = session.CloseWithError(CodeKeepaliveTimeout, errKeepaliveTimeout.Error())
+			return errKeepaliveTimeout
+		}
 		if err != nil {
 			log.Error().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Err(err).Msg("read keepalive")
 			return err
 		}
+		cs.rtt.Store(int64(time.Since(sentAt)))
+		if keepMsg[0] == keepaliveControl {
+			msg := NewDecodeBuffer()
+			if _, err := msg.ReadFrom(stream); err != nil {
+				log.Error().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Err(err).Msg("read control message")
+				return err
+			}
+			if msg.MessageType == Migrate {
+				select {
+				case migrate <- string(msg.Buffer):
+				default:
+				}
+			}
+		}
 		log.Debug().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).
 			Int64("StreamID", int64(streamID)).Str("Role", "client").Msg("read keepalive")
 	}
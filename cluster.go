@@ -0,0 +1,460 @@
+package rdialer
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/midy177/webtransport-go"
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+)
+
+// 集群节点间握手请求头
+const (
+	// peerHeader 携带节点 ID，请求和响应中都会设置
+	peerHeader = "rdialer-peer"
+	// peerTokenHeader 携带节点间共享密钥，供默认的 PeerAuthorizer 校验
+	peerTokenHeader = "rdialer-peer-token"
+)
+
+var errNoOwner = errors.New("no cluster node holds the client")
+
+// PeerAuthorizer 认证集群对等节点的连接请求，返回对端节点 ID
+type PeerAuthorizer func(req *http.Request) (nodeID string, authed bool, err error)
+
+// ClusterConfig 配置服务端集群，节点之间复用 WebTransport 传输互相连接，
+// 通告各自持有的 clientKey，并将发往其他节点所持有客户端的拨号转发给该节点
+type ClusterConfig struct {
+	NodeID string   // 本节点 ID，集群内唯一
+	Peers  []string // 对等节点地址，如 https://node2:8443/connect
+	Token  string   // 节点间共享密钥，供默认的 PeerAuthorizer 使用
+	// PeerAuthorizer 认证对等节点，默认校验请求头中的 Token
+	PeerAuthorizer PeerAuthorizer
+	// HopLimit 一次拨号最多经过的转发次数，用于防止转发环路，默认 2
+	HopLimit int
+	// AnnounceInterval 通告本节点 clientKey 的间隔，默认 5 秒
+	AnnounceInterval time.Duration
+	// TLSConfig 连接对等节点时使用的 TLS 配置，默认跳过证书校验
+	TLSConfig *tls.Config
+	// Registry 存储 clientKey 的归属记录，默认使用 TTL 为 3 倍通告间隔的内存实现
+	Registry Registry
+}
+
+// WithCluster 启用服务端集群
+func WithCluster(config ClusterConfig) ServerOption {
+	return func(s *Server) {
+		s.cluster = newCluster(config, s.sessions)
+		s.sessions.listener = s.cluster
+	}
+}
+
+type cluster struct {
+	config   ClusterConfig
+	sessions *sessionManager
+
+	mu    sync.Mutex
+	links map[string][]*peerLink // 以节点 ID 为键的节点间会话
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// peerLink 表示与一个对等节点之间的会话
+type peerLink struct {
+	nodeID  string
+	session *webtransport.Session
+	stats   streamStats
+}
+
+// peerAnnouncement 是节点周期性通告的本节点归属记录
+type peerAnnouncement struct {
+	NodeID  string   `json:"nodeId"`
+	Records []Record `json:"records"`
+}
+
+// forwardRequest 是 Forward 消息的内容
+type forwardRequest struct {
+	ClientKey string `json:"clientKey"`
+	Proto     string `json:"proto"`
+	Address   string `json:"address"`
+	Hops      int    `json:"hops"` // 接收方还可以继续转发的次数
+	// Timeouts 是发起节点的隧道超时，沿转发路径传递给最终拨号的客户端
+	Timeouts TunnelTimeouts `json:"timeouts,omitempty"`
+}
+
+func newCluster(config ClusterConfig, sessions *sessionManager) *cluster {
+	if config.HopLimit <= 0 {
+		config.HopLimit = 2
+	}
+	if config.AnnounceInterval <= 0 {
+		config.AnnounceInterval = 5 * time.Second
+	}
+	if config.PeerAuthorizer == nil {
+		config.PeerAuthorizer = tokenPeerAuthorizer(config.Token)
+	}
+	if config.Registry == nil {
+		config.Registry = NewMemoryRegistry(3 * config.AnnounceInterval)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &cluster{
+		config:   config,
+		sessions: sessions,
+		links:    make(map[string][]*peerLink),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// tokenPeerAuthorizer 校验请求头中的共享密钥，密钥为空时拒绝所有节点
+func tokenPeerAuthorizer(token string) PeerAuthorizer {
+	return func(req *http.Request) (string, bool, error) {
+		nodeID := req.Header.Get(peerHeader)
+		given := req.Header.Get(peerTokenHeader)
+		authed := token != "" && nodeID != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+		return nodeID, authed, nil
+	}
+}
+
+// start 开始连接所有配置的对等节点并周期性刷新本节点的归属记录
+func (c *cluster) start() {
+	for _, peer := range c.config.Peers {
+		go c.dialLoop(peer)
+	}
+	go c.refreshLoop()
+}
+
+// close 断开所有节点间会话并停止重连，同时删除本节点的归属记录
+func (c *cluster) close() {
+	c.cancel()
+	for _, record := range c.localRecords() {
+		_ = c.config.Registry.Delete(context.Background(), record.ClientKey, c.config.NodeID)
+	}
+	c.mu.Lock()
+	var links []*peerLink
+	for _, l := range c.links {
+		links = append(links, l...)
+	}
+	c.mu.Unlock()
+	for _, link := range links {
+		_ = link.session.CloseWithError(CodeShutdown, "服务器关闭")
+	}
+}
+
+// dialLoop 维持到一个对等节点的会话，断开后重连
+func (c *cluster) dialLoop(peer string) {
+	for c.ctx.Err() == nil {
+		nodeID, session, err := c.dial(peer)
+		if err != nil {
+			log.Warn().Str("Peer", peer).Err(err).Msg("connect to cluster peer failed")
+		} else {
+			c.serveLink(nodeID, session)
+		}
+		select {
+		case <-c.ctx.Done():
+		case <-time.After(c.config.AnnounceInterval):
+		}
+	}
+}
+
+func (c *cluster) dial(peer string) (string, *webtransport.Session, error) {
+	tlsConfig := c.config.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{
+			InsecureSkipVerify: true, // 注意：生产环境应该使用有效证书
+			NextProtos:         []string{"h3"},
+		}
+	}
+	dialer := &webtransport.Dialer{
+		TLSClientConfig: tlsConfig,
+		QUICConfig: &quic.Config{
+			MaxIncomingStreams: 100000,
+			EnableDatagrams:    true,
+		},
+	}
+	header := make(http.Header)
+	header.Set(peerHeader, c.config.NodeID)
+	header.Set(peerTokenHeader, c.config.Token)
+	resp, session, err := dialer.Dial(c.ctx, peer, header)
+	if err != nil {
+		return "", nil, fmt.Errorf("WebTransport Connection failed: %w", err)
+	}
+	nodeID := resp.Header.Get(peerHeader)
+	if nodeID == "" {
+		_ = session.CloseWithError(0, "missing peer node id")
+		return "", nil, errors.New("peer did not report its node id")
+	}
+	return nodeID, session, nil
+}
+
+// accept 处理对等节点发起的连接，阻塞直到会话断开
+func (c *cluster) accept(w http.ResponseWriter, r *http.Request, s *Server) {
+	nodeID, authed, err := c.config.PeerAuthorizer(r)
+	if err != nil {
+		s.errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if !authed || nodeID == "" || nodeID == c.config.NodeID {
+		s.errorWriter(w, r, http.StatusUnauthorized, errFailedAuth)
+		return
+	}
+	w.Header().Set(peerHeader, c.config.NodeID)
+	session, err := s.wtServer.Upgrade(w, r)
+	if err != nil {
+		log.Err(err).Msg("Upgrade failed")
+		return
+	}
+	c.serveLink(nodeID, session)
+}
+
+// serveLink 登记节点间会话并处理其上的流，阻塞直到会话断开
+func (c *cluster) serveLink(nodeID string, session *webtransport.Session) {
+	link := &peerLink{nodeID: nodeID, session: session}
+	c.mu.Lock()
+	c.links[nodeID] = append(c.links[nodeID], link)
+	c.mu.Unlock()
+	log.Info().Str("Node", nodeID).Str("RemoteAddr", session.RemoteAddr().String()).Msg("Cluster peer connected")
+
+	go c.announce(link)
+	handleSession("peer:"+nodeID, session, &link.stats, newSessionLimiter(), concurrencyLimits{}, c.sessions.timeouts, map[MessageType]messageHandler{
+		Announce: c.handleAnnounce(nodeID),
+		Forward:  c.handleForward(link),
+	})
+
+	c.mu.Lock()
+	links := c.links[nodeID]
+	for i, l := range links {
+		if l == link {
+			links = append(links[:i], links[i+1:]...)
+			break
+		}
+	}
+	if len(links) == 0 {
+		delete(c.links, nodeID)
+	} else {
+		c.links[nodeID] = links
+	}
+	c.mu.Unlock()
+	log.Info().Str("Node", nodeID).Msg("Cluster peer disconnected")
+}
+
+// announce 在节点间会话上周期性通告本节点持有的 clientKey
+func (c *cluster) announce(link *peerLink) {
+	stream, err := link.session.OpenStream()
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	for {
+		data, _ := json.Marshal(peerAnnouncement{
+			NodeID:  c.config.NodeID,
+			Records: nonNil(c.localRecords()),
+		})
+		if _, err := NewEncodeBuffer(Announce, data).WriteTo(stream); err != nil {
+			log.Debug().Str("Node", link.nodeID).Err(err).Msg("write announce")
+			return
+		}
+		select {
+		case <-link.session.Context().Done():
+			return
+		case <-time.After(c.config.AnnounceInterval):
+		}
+	}
+}
+
+// handleAnnounce 持续读取对端节点的通告
+func (c *cluster) handleAnnounce(nodeID string) messageHandler {
+	return func(stream webtransport.Stream, payload []byte) {
+		for {
+			var ann peerAnnouncement
+			if err := json.Unmarshal(payload, &ann); err != nil {
+				log.Error().Str("Node", nodeID).Err(err).Msg("decode announce")
+				return
+			}
+			for _, record := range ann.Records {
+				// 使用本地时间刷新，避免节点间时钟偏差影响过期判断
+				record.NodeID = nodeID
+				record.LastSeen = time.Now()
+				if err := c.config.Registry.Put(c.ctx, record); err != nil {
+					log.Warn().Str("Node", nodeID).Err(err).Msg("registry put")
+				}
+			}
+
+			decodeBuffer := NewDecodeBuffer()
+			if _, err := decodeBuffer.ReadFrom(stream); err != nil {
+				return
+			}
+			payload = decodeBuffer.Buffer
+		}
+	}
+}
+
+// ownerLinks 根据归属记录返回持有 clientKey 的节点的会话，跳过本节点和 exclude 节点
+func (c *cluster) ownerLinks(clientKey, exclude string) []*peerLink {
+	records, err := c.config.Registry.Lookup(c.ctx, clientKey)
+	if err != nil {
+		log.Warn().Str("ClientKey", clientKey).Err(err).Msg("registry lookup")
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var links []*peerLink
+	for _, record := range records {
+		if record.NodeID == c.config.NodeID || record.NodeID == exclude {
+			continue
+		}
+		links = append(links, c.links[record.NodeID]...)
+	}
+	return links
+}
+
+// localRecords 返回本节点持有的 clientKey 的归属记录
+func (c *cluster) localRecords() []Record {
+	var records []Record
+	for _, clientKey := range c.sessions.clientKeys() {
+		if record, ok := c.localRecord(clientKey); ok {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func (c *cluster) localRecord(clientKey string) (Record, bool) {
+	sessions := c.sessions.sessionsOf(clientKey)
+	if len(sessions) == 0 {
+		return Record{}, false
+	}
+	return Record{
+		ClientKey: clientKey,
+		NodeID:    c.config.NodeID,
+		Labels:    sessions[0].currentLabels(),
+		LastSeen:  time.Now(),
+	}, true
+}
+
+// refreshLoop 周期性刷新本节点的归属记录，避免在共享的 Registry 中过期
+func (c *cluster) refreshLoop() {
+	for {
+		for _, record := range c.localRecords() {
+			if err := c.config.Registry.Put(c.ctx, record); err != nil {
+				log.Warn().Str("ClientKey", record.ClientKey).Err(err).Msg("registry put")
+			}
+		}
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(c.config.AnnounceInterval):
+		}
+	}
+}
+
+func (c *cluster) sessionAdded(clientKey string, _ int64) {
+	if record, ok := c.localRecord(clientKey); ok {
+		if err := c.config.Registry.Put(c.ctx, record); err != nil {
+			log.Warn().Str("ClientKey", clientKey).Err(err).Msg("registry put")
+		}
+	}
+}
+
+func (c *cluster) sessionRemoved(clientKey string, _ int64) {
+	if len(c.sessions.sessionsOf(clientKey)) > 0 {
+		return
+	}
+	if err := c.config.Registry.Delete(c.ctx, clientKey, c.config.NodeID); err != nil {
+		log.Warn().Str("ClientKey", clientKey).Err(err).Msg("registry delete")
+	}
+}
+
+// getDialer 返回优先使用本地会话、本地没有会话时转发到持有该客户端的节点的拨号器
+func (c *cluster) getDialer(clientKey string) (Dialer, error) {
+	if _, err := c.sessions.pick(clientKey, nil); err != nil && len(c.ownerLinks(clientKey, "")) == 0 {
+		return nil, err
+	}
+	return c.dialer(clientKey, c.config.HopLimit-1, ""), nil
+}
+
+// dialer 返回发往 clientKey 的拨号器，hops 为转发后接收方还可以继续转发的次数，from 为请求来源节点
+func (c *cluster) dialer(clientKey string, hops int, from string) Dialer {
+	return func(ctx context.Context, proto, address string) (net.Conn, error) {
+		local, err := c.sessions.getDialer(clientKey)
+		if err == nil {
+			conn, err := local(ctx, proto, address)
+			if err == nil || len(c.ownerLinks(clientKey, from)) == 0 {
+				return conn, err
+			}
+		}
+		if hops < 0 {
+			return nil, errNoOwner
+		}
+		return c.forward(ctx, clientKey, hops, from, proto, address)
+	}
+}
+
+// forward 通过持有 clientKey 的对等节点打开隧道连接
+func (c *cluster) forward(ctx context.Context, clientKey string, hops int, from, proto, address string) (net.Conn, error) {
+	data, err := json.Marshal(forwardRequest{
+		ClientKey: clientKey,
+		Proto:     proto,
+		Address:   address,
+		Hops:      hops,
+		Timeouts:  dialTimeoutsFrom(ctx).or(c.sessions.timeouts),
+	})
+	if err != nil {
+		return nil, err
+	}
+	lastErr := errNoOwner
+	for _, link := range c.ownerLinks(clientKey, from) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		conn, err := openTunnel(link.session, &link.stats, proto, address, func(w io.Writer) error {
+			_, err := NewEncodeBuffer(Forward, data).WriteTo(w)
+			return err
+		})
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// handleForward 处理对等节点转发的拨号，本地没有该客户端时在跳数允许的范围内继续转发
+func (c *cluster) handleForward(link *peerLink) messageHandler {
+	return func(stream webtransport.Stream, payload []byte) {
+		var req forwardRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			log.Error().Str("Node", link.nodeID).Err(err).Msg("decode forward")
+			return
+		}
+		if req.Hops < 0 {
+			log.Warn().Str("Node", link.nodeID).Str("ClientKey", req.ClientKey).Msg("forward hop limit exceeded")
+			return
+		}
+		ctx := c.ctx
+		if req.Timeouts != (TunnelTimeouts{}) {
+			ctx = WithDialTimeouts(ctx, req.Timeouts)
+		}
+		target, err := c.dialer(req.ClientKey, req.Hops-1, link.nodeID)(ctx, req.Proto, req.Address)
+		if err != nil {
+			log.Warn().Str("Node", link.nodeID).Str("ClientKey", req.ClientKey).Err(err).Msg("forward dial failed")
+			return
+		}
+		conn, err := newConnection(stream, req.Proto, req.Address, &link.stats)
+		if err != nil {
+			_ = target.Close()
+			return
+		}
+		conn.accepted = true
+		link.stats.track(conn)
+		conn.recordClose(pipe(conn, target, req.Timeouts.or(c.sessions.timeouts)))
+	}
+}
@@ -1,29 +1,75 @@
 package rdialer
 
 import (
+	"io"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/midy177/webtransport-go"
+	"github.com/rs/zerolog/log"
 )
 
 type connection struct {
-	addr   *addr
-	stream webtransport.Stream
+	addr      *addr
+	stream    webtransport.Stream
+	stats     *streamStats // 会话级流量统计，可为 nil
+	onClose   func()       // 首次关闭时调用，可为 nil
+	closeOnce sync.Once
+	startedAt time.Time
+	accepted  bool // 由对端打开的流，本端负责拨号目标地址
+	bytesIn   int64
+	bytesOut  int64
+	early     *earlyData // 乐观拨号时尚未发送的 Connect 消息和尚未读取的拨号结果，可为 nil
+	// 读写两个方向的带宽整形，未限制带宽时为 nil
+	readShaper  *bandwidthShaper
+	writeShaper *bandwidthShaper
+	// 转发数据时两个方向已读取尚未写出的字节数，inBudget 为从对端读取、outBudget 为写入对端
+	inBudget  *streamBackPressure
+	outBudget *streamBackPressure
 }
 
-func newConnection(conn webtransport.Stream, proto, address string) (net.Conn, error) {
-	return &connection{
-		stream: conn,
-		addr:   &addr{proto, address},
-	}, nil
+func newConnection(conn webtransport.Stream, proto, address string, stats *streamStats) (*connection, error) {
+	c := &connection{
+		stream:    conn,
+		addr:      &addr{proto, address},
+		stats:     stats,
+		startedAt: time.Now(),
+	}
+	var budget *budgetGroup
+	if stats != nil {
+		c.readShaper, c.writeShaper = stats.shaping.shapers(0)
+		budget = stats.budget
+	}
+	c.inBudget, c.outBudget = budget.newStream(), budget.newStream()
+	return c, nil
 }
 
 func (c *connection) Close() error {
+	c.closeOnce.Do(func() {
+		if c.stats != nil {
+			c.stats.tunnels.Delete(c)
+		}
+		if c.onClose != nil {
+			c.onClose()
+		}
+		c.closeShapers()
+		c.inBudget.Close()
+		c.outBudget.Close()
+	})
+	// 与 net.Conn 语义一致，关闭后不再读取，阻塞中的 Read 立即返回
+	c.stream.CancelRead(0)
 	return c.stream.Close()
 }
 
+// abort 丢弃尚未发送的数据并关闭连接，阻塞中的 Write 立即返回
+func (c *connection) abort() {
+	c.stream.CancelWrite(0)
+	_ = c.Close()
+}
+
 func (c *connection) SetDeadline(t time.Time) error {
 	return c.stream.SetDeadline(t)
 }
@@ -45,10 +91,29 @@ func (c *connection) RemoteAddr() net.Addr {
 }
 
 func (c *connection) Read(p []byte) (int, error) {
+	if c.early != nil {
+		if err := c.early.flush(c.stream); err != nil {
+			return 0, overloadError(err)
+		}
+		if err := c.early.result(c.stream, c.addr.proto, c.addr.address); err != nil {
+			return 0, overloadError(err)
+		}
+	}
 	n, err := c.stream.Read(p)
+	if n > 0 {
+		c.throttle(c.readShaper, n)
+		atomic.AddInt64(&c.bytesIn, int64(n))
+		if c.stats != nil {
+			atomic.AddInt64(&c.stats.bytesIn, int64(n))
+		}
+	}
 	if err != nil {
+		if err = overloadError(err); err == ErrOverloaded {
+			return n, err
+		}
+		// 对端重置流视为连接结束，返回 io.EOF 而不是 (0, nil)，避免调用方空转
 		if strings.HasPrefix(err.Error(), "stream reset") {
-			return n, nil
+			return n, io.EOF
 		}
 	}
 	return n, err
@@ -56,7 +121,21 @@ func (c *connection) Read(p []byte) (int, error) {
 
 func (c *connection) Write(p []byte) (int, error) {
 	// 直接使用 Stream 的写入方法，依赖 QUIC 的内置流控制
-	return c.stream.Write(p)
+	c.throttle(c.writeShaper, len(p))
+	var n int
+	var err error
+	if c.early != nil && !c.early.sent.Load() {
+		n, err = c.early.write(c.stream, p)
+	} else {
+		n, err = c.stream.Write(p)
+	}
+	if n > 0 {
+		atomic.AddInt64(&c.bytesOut, int64(n))
+		if c.stats != nil {
+			atomic.AddInt64(&c.stats.bytesOut, int64(n))
+		}
+	}
+	return n, overloadError(err)
 }
 
 type addr struct {
@@ -71,3 +150,45 @@ func (a *addr) Network() string {
 func (a *addr) String() string {
 	return a.address
 }
+
+// recordClose 记录隧道连接的关闭原因
+func (c *connection) recordClose(reason closeReason) {
+	if c.stats != nil {
+		switch reason {
+		case closeIdle:
+			atomic.AddInt64(&c.stats.idleClosed, 1)
+		case closeLifetime:
+			atomic.AddInt64(&c.stats.lifetimeClosed, 1)
+		}
+	}
+	log.Debug().Str("Network", c.addr.Network()).Str("Address", c.addr.String()).
+		Int64("StreamID", int64(c.stream.StreamID())).Str("Reason", string(reason)).
+		Dur("Duration", time.Since(c.startedAt)).Msg("tunnel closed")
+}
+
+// throttle 等待 n 个字节的带宽配额，连接关闭后立即返回
+func (c *connection) throttle(shaper *bandwidthShaper, n int) {
+	if shaper == nil {
+		return
+	}
+	shaper.Update(n)
+	_ = shaper.Wait()
+}
+
+// setBandwidth 以 bytesPerSecond 覆盖连接级别的带宽限制
+func (c *connection) setBandwidth(bytesPerSecond int) {
+	if c.stats == nil || bytesPerSecond <= 0 {
+		return
+	}
+	c.closeShapers()
+	c.readShaper, c.writeShaper = c.stats.shaping.shapers(bytesPerSecond)
+}
+
+func (c *connection) closeShapers() {
+	if c.readShaper != nil {
+		c.readShaper.Close()
+	}
+	if c.writeShaper != nil {
+		c.writeShaper.Close()
+	}
+}
@@ -0,0 +1,461 @@
+package rdialer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/midy177/webtransport-go"
+	"github.com/rs/zerolog/log"
+)
+
+// 控制通道是客户端在会话建立后打开的长期双向流，首帧类型为 Control，
+// 之后双方以 EncodeBuffer/DecodeBuffer 帧交换控制消息，帧类型标识消息，消息体为 JSON。
+// 协议版本 3 起替代单字节回显的保活流，服务端在握手响应头中声明自身的协议版本。
+
+// controlVersion 是支持控制通道的最低协议版本
+const controlVersion = 3
+
+// ControlMessage 是控制通道上的消息
+type ControlMessage interface {
+	// Type 返回消息的帧类型
+	Type() MessageType
+}
+
+// Ping 由双方按间隔发送，对端以携带相同时间戳的 Pong 应答
+type Ping struct {
+	Timestamp int64 `json:"timestamp"` // 发送方时钟的 UnixNano
+}
+
+// Pong 应答 Ping，发送方据此计算往返时延
+type Pong struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+// LabelUpdate 由客户端发送，替换会话声明的标签，认证方赋予的标签仍然优先
+type LabelUpdate struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// Policy 由服务端下发，零值字段表示不修改
+type Policy struct {
+	PingInterval time.Duration     `json:"pingInterval,omitempty"`
+	Values       map[string]string `json:"values,omitempty"` // 应用自定义的策略项
+}
+
+// GoAwayNotice 由服务端发送，要求客户端重连到其他服务端并停止在本会话上发起新的流
+type GoAwayNotice struct {
+	Reason string `json:"reason"`
+}
+
+// MigrateNotice 由服务端发送，要求客户端迁移到 URL
+type MigrateNotice struct {
+	URL string `json:"url"`
+}
+
+// ReAuthRequest 由服务端发送，要求客户端以 ReAuthResponse 重新提交凭据
+type ReAuthRequest struct{}
+
+// ReAuthResponse 携带客户端重新认证的请求头，服务端使用同一认证方校验
+type ReAuthResponse struct {
+	Header http.Header `json:"header"`
+}
+
+// ErrorNotice 通知对端发生的错误，双方都可以发送
+type ErrorNotice struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (Ping) Type() MessageType           { return PingMessage }
+func (Pong) Type() MessageType           { return PongMessage }
+func (LabelUpdate) Type() MessageType    { return LabelUpdateMessage }
+func (Policy) Type() MessageType         { return PolicyMessage }
+func (GoAwayNotice) Type() MessageType   { return GoAway }
+func (MigrateNotice) Type() MessageType  { return Migrate }
+func (ReAuthRequest) Type() MessageType  { return ReAuthRequestMessage }
+func (ReAuthResponse) Type() MessageType { return ReAuthResponseMessage }
+func (ErrorNotice) Type() MessageType    { return ErrorMessage }
+
+// decodeControl 按帧类型解码控制消息
+func decodeControl(t MessageType, payload []byte) (ControlMessage, error) {
+	switch t {
+	case PingMessage:
+		return decodeAs[Ping](payload)
+	case PongMessage:
+		return decodeAs[Pong](payload)
+	case LabelUpdateMessage:
+		return decodeAs[LabelUpdate](payload)
+	case PolicyMessage:
+		return decodeAs[Policy](payload)
+	case GoAway:
+		return decodeAs[GoAwayNotice](payload)
+	case Migrate:
+		return decodeAs[MigrateNotice](payload)
+	case ReAuthRequestMessage:
+		return decodeAs[ReAuthRequest](payload)
+	case ReAuthResponseMessage:
+		return decodeAs[ReAuthResponse](payload)
+	case ErrorMessage:
+		return decodeAs[ErrorNotice](payload)
+	}
+	return nil, fmt.Errorf("unsupported control message type %d", t)
+}
+
+func decodeAs[T ControlMessage](payload []byte) (ControlMessage, error) {
+	var msg T
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// controlChannel 是控制通道的一端
+type controlChannel struct {
+	stream       webtransport.Stream
+	mu           sync.Mutex   // 串行化帧的写入
+	rtt          atomic.Int64 // 最近一次 Ping 测得的往返时延（纳秒）
+	lastSeen     atomic.Int64 // 最近一次收到对端消息的时间（UnixNano）
+	pingInterval atomic.Int64
+	keepalive    keepaliveConfig
+	prober       *datagramProber // 使用数据报探测时非 nil，只在探测未应答时发送 Ping
+}
+
+func newControlChannel(stream webtransport.Stream, keepalive keepaliveConfig) *controlChannel {
+	cc := &controlChannel{stream: stream, keepalive: keepalive}
+	cc.pingInterval.Store(int64(keepalive.interval))
+	cc.lastSeen.Store(time.Now().UnixNano())
+	return cc
+}
+
+// send 发送一条控制消息
+func (cc *controlChannel) send(msg ControlMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	_, err = NewEncodeBuffer(msg.Type(), data).WriteTo(cc.stream)
+	return err
+}
+
+// run 读取控制消息直到流关闭，Ping 自动应答，Pong 更新往返时延，全部消息随后交给 handle
+func (cc *controlChannel) run(handle func(ControlMessage)) error {
+	for {
+		frame := NewDecodeBuffer()
+		if _, err := frame.ReadFrom(cc.stream); err != nil {
+			return err
+		}
+		cc.lastSeen.Store(time.Now().UnixNano())
+		msg, err := decodeControl(frame.MessageType, frame.Buffer)
+		if err != nil {
+			log.Warn().Int64("StreamID", int64(cc.stream.StreamID())).Err(err).Msg("decode control message")
+			continue
+		}
+		switch m := msg.(type) {
+		case Ping:
+			if err := cc.send(Pong{Timestamp: m.Timestamp}); err != nil {
+				return err
+			}
+		case Pong:
+			cc.rtt.Store(time.Now().UnixNano() - m.Timestamp)
+		}
+		handle(msg)
+	}
+}
+
+// pingLoop 按间隔发送 Ping 或数据报探测，直到 ctx 结束或发送失败；
+// 连续 maxMissed 个间隔未收到对端的任何消息时调用 onDead 后返回
+func (cc *controlChannel) pingLoop(ctx context.Context, onDead func()) {
+	for {
+		interval := time.Duration(cc.pingInterval.Load())
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if time.Since(time.Unix(0, cc.lastSeen.Load())) > cc.keepalive.timeout(interval) {
+			onDead()
+			return
+		}
+		if cc.prober != nil {
+			cc.prober.probe(cc.keepalive.timeout(interval))
+			// 发送队列已满时 quic-go 会丢弃数据报，大流量下可能连续丢失探测。
+			// 上个间隔没有收到任何消息时同时在控制流上发送 Ping，只有可靠的 Ping 也未应答才判定会话失效
+			if time.Since(time.Unix(0, cc.lastSeen.Load())) <= interval {
+				continue
+			}
+		}
+		if err := cc.send(Ping{Timestamp: time.Now().UnixNano()}); err != nil {
+			return
+		}
+	}
+}
+
+// close 中止控制通道的读写
+func (cc *controlChannel) close() {
+	cc.stream.CancelRead(0)
+	cc.stream.CancelWrite(0)
+}
+
+// OnControl 订阅客户端发来的控制消息，handler 在控制通道的读取协程中同步调用，不应阻塞
+func (s *Server) OnControl(handler func(clientKey string, msg ControlMessage)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.controlHandlers = append(s.controlHandlers, handler)
+}
+
+// SendControl 向 clientKey 的全部会话发送控制消息，返回发送成功的会话数，未建立控制通道的旧版本客户端会被跳过
+func (s *Server) SendControl(clientKey string, msg ControlMessage) int {
+	var n int
+	for _, ss := range s.sessions.sessionsOf(clientKey) {
+		cc := ss.control.Load()
+		if cc == nil {
+			continue
+		}
+		armed := false
+		if _, ok := msg.(ReAuthRequest); ok {
+			armed = ss.awaitReauth(s.reauthTimeout)
+		}
+		if err := cc.send(msg); err != nil {
+			if armed {
+				ss.reauthDone()
+			}
+			log.Warn().Str("ClientKey", clientKey).Err(err).Msg("send control message failed")
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// PushPolicy 向 clientKey 的全部会话下发策略，返回下发成功的会话数
+func (s *Server) PushPolicy(clientKey string, policy Policy) int {
+	return s.SendControl(clientKey, policy)
+}
+
+// DefaultReauthTimeout 是服务端要求重新认证后等待客户端应答的默认时长
+const DefaultReauthTimeout = 30 * time.Second
+
+// WithReauthTimeout 设置要求重新认证后等待 ReAuthResponse 的最长时间，超时未应答的会话以 CodeKicked 关闭。
+// 为 0 时使用 DefaultReauthTimeout，小于 0 表示不限制
+func WithReauthTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.reauthTimeout = timeout
+	}
+}
+
+// RequestReauth 要求 clientKey 的全部会话重新认证，认证失败或超时未应答的会话被关闭，返回通知到的会话数
+func (s *Server) RequestReauth(clientKey string) int {
+	return s.SendControl(clientKey, ReAuthRequest{})
+}
+
+// serveControl 运行服务端一侧的控制通道，直到流关闭
+func (s *Server) serveControl(ss *serverSession, stream webtransport.Stream) {
+	cc := newControlChannel(stream, s.keepalive)
+	ss.control.Store(cc)
+	defer ss.control.CompareAndSwap(cc, nil)
+
+	ctx, cancel := context.WithCancel(ss.session.Context())
+	defer cancel()
+	cc.startDatagrams(ctx, ss.session, ss.protocolVersion)
+	go cc.pingLoop(ctx, ss.evict)
+	err := cc.run(func(msg ControlMessage) {
+		s.handleControl(ss, cc, msg)
+	})
+	log.Debug().Str("ClientKey", ss.clientKey).Err(err).Msg("control channel closed")
+}
+
+// handleControl 处理客户端发来的控制消息并通知订阅者
+func (s *Server) handleControl(ss *serverSession, cc *controlChannel, msg ControlMessage) {
+	switch m := msg.(type) {
+	case LabelUpdate:
+		ss.setLabels(m.Labels)
+		log.Info().Str("ClientKey", ss.clientKey).Str("Labels", formatLabels(m.Labels)).Msg("session labels updated")
+	case ReAuthResponse:
+		s.reauth(ss, cc, m.Header)
+	case ErrorNotice:
+		log.Warn().Str("ClientKey", ss.clientKey).Int("Code", m.Code).Str("Message", m.Message).Msg("client reported error")
+	}
+
+	s.mu.Lock()
+	handlers := s.controlHandlers
+	s.mu.Unlock()
+	for _, handler := range handlers {
+		handler(ss.clientKey, msg)
+	}
+}
+
+// reauth 使用认证方校验客户端重新提交的凭据，未通过或 clientKey 发生变化时关闭会话
+func (s *Server) reauth(ss *serverSession, cc *controlChannel, header http.Header) {
+	ss.reauthDone()
+	r, err := http.NewRequestWithContext(ss.session.Context(), http.MethodConnect, "/", nil)
+	if err != nil {
+		return
+	}
+	r.Header = header
+	r.RemoteAddr = ss.session.RemoteAddr().String()
+	identity, authed, err := s.authorizer(r)
+	if err == nil && authed && identity != nil && identity.ClientKey == ss.clientKey {
+		log.Info().Str("ClientKey", ss.clientKey).Msg("session reauthenticated")
+		return
+	}
+	log.Warn().Str("ClientKey", ss.clientKey).Err(err).Msg("reauthentication failed")
+	_ = cc.send(ErrorNotice{Code: http.StatusUnauthorized, Message: "reauthentication failed"})
+	_ = ss.session.CloseWithError(CodeKicked, "reauthentication failed")
+}
+
+// awaitReauth 在要求重新认证前调用，timeout 内未收到应答时以 CodeKicked 关闭会话。
+// 已在等待应答时保留原有的期限，设置了新的期限时返回 true
+func (ss *serverSession) awaitReauth(timeout time.Duration) bool {
+	if timeout <= 0 {
+		return false
+	}
+	timer := time.AfterFunc(timeout, func() {
+		log.Warn().Str("ClientKey", ss.clientKey).Dur("Timeout", timeout).Msg("reauthentication timed out")
+		_ = ss.session.CloseWithError(CodeKicked, "reauthentication timed out")
+	})
+	if !ss.reauthTimer.CompareAndSwap(nil, timer) {
+		timer.Stop()
+		return false
+	}
+	return true
+}
+
+// reauthDone 取消等待重新认证应答的期限
+func (ss *serverSession) reauthDone() {
+	if timer := ss.reauthTimer.Swap(nil); timer != nil {
+		timer.Stop()
+	}
+}
+
+// currentLabels 返回会话当前的标签，返回的 map 不可修改
+func (ss *serverSession) currentLabels() map[string]string {
+	if labels := ss.labels.Load(); labels != nil {
+		return *labels
+	}
+	return nil
+}
+
+// setLabels 替换会话声明的标签，认证方赋予的标签覆盖同名标签
+func (ss *serverSession) setLabels(declared map[string]string) {
+	labels := maps.Clone(declared)
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	maps.Copy(labels, ss.identityLabels)
+	ss.labels.Store(&labels)
+}
+
+// WithReauth 设置服务端要求重新认证时提供凭据的函数，未设置时沿用建立会话时的请求头
+func WithReauth(credentials func(ctx context.Context) (http.Header, error)) ClientOption {
+	return func(c *Client) {
+		c.reauth = credentials
+	}
+}
+
+// OnControl 订阅服务端发来的控制消息，handler 在控制通道的读取协程中同步调用，不应阻塞
+func (c *Client) OnControl(handler func(msg ControlMessage)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.controlHandlers = append(c.controlHandlers, handler)
+}
+
+// SendControl 在全部会话的控制通道上发送控制消息，没有会话建立控制通道时返回错误
+func (c *Client) SendControl(msg ControlMessage) error {
+	c.mu.Lock()
+	sessions := append([]*clientSession(nil), c.sessions...)
+	c.mu.Unlock()
+
+	var (
+		sent    int
+		lastErr error = errNoControlChannel
+	)
+	for _, cs := range sessions {
+		cc := cs.control.Load()
+		if cc == nil {
+			continue
+		}
+		if err := cc.send(msg); err != nil {
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// UpdateLabels 替换客户端标签并通知服务端，之后建立的会话也使用新标签
+func (c *Client) UpdateLabels(labels map[string]string) error {
+	c.mu.Lock()
+	c.labels = maps.Clone(labels)
+	c.mu.Unlock()
+	return c.SendControl(LabelUpdate{Labels: labels})
+}
+
+// runControl 运行客户端一侧的控制通道，直到流关闭，迁移目标发送到 migrate
+func (c *Client) runControl(ctx context.Context, cs *clientSession, cc *controlChannel, migrate chan<- string) error {
+	remoteAddr := cs.session.RemoteAddr().String()
+	log.Info().Str("LocalAddr", cs.session.LocalAddr().String()).Str("RemoteAddr", remoteAddr).Msg("Successfully connected to rdialer")
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cc.startDatagrams(ctx, cs.session, cs.serverVersion)
+	go cc.pingLoop(ctx, func() {
+		log.Warn().Str("RemoteAddr", remoteAddr).Msg("keepalive timeout, closing session")
+		_ = cs.session.CloseWithError(CodeKeepaliveTimeout, errKeepaliveTimeout.Error())
+	})
+	return cc.run(func(msg ControlMessage) {
+		switch m := msg.(type) {
+		case GoAwayNotice:
+			cs.goAway.trigger(remoteAddr, m.Reason)
+		case MigrateNotice:
+			select {
+			case migrate <- m.URL:
+			default:
+			}
+		case Policy:
+			if m.PingInterval > 0 {
+				cc.pingInterval.Store(int64(m.PingInterval))
+			}
+		case ReAuthRequest:
+			go c.respondReauth(ctx, cs, cc)
+		case ErrorNotice:
+			log.Warn().Str("RemoteAddr", remoteAddr).Int("Code", m.Code).Str("Message", m.Message).Msg("server reported error")
+		}
+
+		c.mu.Lock()
+		handlers := c.controlHandlers
+		c.mu.Unlock()
+		for _, handler := range handlers {
+			handler(msg)
+		}
+	})
+}
+
+// respondReauth 应答服务端的重新认证请求
+func (c *Client) respondReauth(ctx context.Context, cs *clientSession, cc *controlChannel) {
+	header := cs.header
+	if c.reauth != nil {
+		h, err := c.reauth(ctx)
+		if err != nil {
+			log.Warn().Err(err).Msg("get reauthentication credentials failed")
+			_ = cc.send(ErrorNotice{Code: http.StatusUnauthorized, Message: err.Error()})
+			return
+		}
+		header = h
+	}
+	if err := cc.send(ReAuthResponse{Header: header}); err != nil {
+		log.Warn().Err(err).Msg("send reauthentication response failed")
+	}
+}
@@ -0,0 +1,130 @@
+package rdialer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/midy177/webtransport-go"
+)
+
+func TestControlRoundTrip(t *testing.T) {
+	tests := []ControlMessage{
+		Ping{Timestamp: 42},
+		Pong{Timestamp: 42},
+		LabelUpdate{Labels: map[string]string{"region": "eu"}},
+		Policy{PingInterval: 5 * time.Second, Values: map[string]string{"k": "v"}},
+		GoAwayNotice{Reason: "server shutting down"},
+		MigrateNotice{URL: "https://example.com/connect"},
+		ReAuthRequest{},
+		ReAuthResponse{Header: http.Header{"Authorization": {"Bearer t"}}},
+		ErrorNotice{Code: http.StatusUnauthorized, Message: "reauthentication failed"},
+	}
+	for _, msg := range tests {
+		t.Run(reflect.TypeOf(msg).Name(), func(t *testing.T) {
+			data, err := json.Marshal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var frame bytes.Buffer
+			if _, err := NewEncodeBuffer(msg.Type(), data).WriteTo(&frame); err != nil {
+				t.Fatal(err)
+			}
+			decodeBuffer := NewDecodeBuffer()
+			if _, err := decodeBuffer.ReadFrom(&frame); err != nil {
+				t.Fatal(err)
+			}
+			if decodeBuffer.MessageType != msg.Type() {
+				t.Fatalf("frame type = %d, want %d", decodeBuffer.MessageType, msg.Type())
+			}
+			got, err := decodeControl(decodeBuffer.MessageType, decodeBuffer.Buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, msg) {
+				t.Fatalf("decoded %#v, want %#v", got, msg)
+			}
+		})
+	}
+}
+
+func TestDecodeControlErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		t       MessageType
+		payload string
+	}{
+		{name: "unsupported type", t: Connect, payload: "{}"},
+		{name: "invalid json", t: PingMessage, payload: "{"},
+		{name: "wrong field type", t: ErrorMessage, payload: `{"code":"x"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if msg, err := decodeControl(tt.t, []byte(tt.payload)); err == nil {
+				t.Fatalf("decodeControl = %#v, want error", msg)
+			}
+		})
+	}
+}
+
+// pongStream 是控制通道的流，每次写入 Ping 后立即记录对端的应答
+type pongStream struct {
+	webtransport.Stream
+	cc    *controlChannel
+	pings atomic.Int64
+}
+
+func (s *pongStream) Write(p []byte) (int, error) {
+	frame := NewDecodeBuffer()
+	if _, err := frame.ReadFrom(bytes.NewReader(p)); err == nil && frame.MessageType == PingMessage {
+		s.pings.Add(1)
+		if s.cc != nil {
+			s.cc.lastSeen.Store(time.Now().UnixNano())
+		}
+	}
+	return len(p), nil
+}
+
+func TestPingLoopDatagramLoss(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	tests := []struct {
+		name     string
+		answered bool // 对端应答控制流上的 Ping
+		wantDead bool
+	}{
+		{name: "stream ping answered", answered: true},
+		{name: "peer gone", wantDead: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &pongStream{}
+			cc := newControlChannel(stream, keepaliveConfig{interval: interval, maxMissed: 3, datagram: true})
+			if tt.answered {
+				stream.cc = cc
+			}
+			// 全部探测数据报都被丢弃
+			var probes atomic.Int64
+			cc.prober = &datagramProber{
+				send:    func([]byte) error { probes.Add(1); return nil },
+				pending: make(map[uint64]time.Time),
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*interval)
+			defer cancel()
+			var dead atomic.Bool
+			cc.pingLoop(ctx, func() { dead.Store(true) })
+
+			if dead.Load() != tt.wantDead {
+				t.Fatalf("session evicted = %v, want %v", dead.Load(), tt.wantDead)
+			}
+			if probes.Load() == 0 || stream.pings.Load() == 0 {
+				t.Fatalf("sent %d probes and %d stream pings, want both", probes.Load(), stream.pings.Load())
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package rdialer
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// copyBufferSize 是数据转发使用的缓冲区大小
+const copyBufferSize = 64 * 1024
+
+// copyBufPool 复用数据转发的缓冲区，避免每个连接、每次复制分配新的缓冲区
+var copyBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// copyBuffer 使用池化缓冲区从 src 复制到 dst 直到 EOF，与 io.Copy 不同，不会转而调用 src 或 dst 的 WriteTo/ReadFrom。
+// bp 不为 nil 时记录已读取尚未写出的字节数，超出预算时暂停读取，每次读取不超过剩余的预算
+func copyBuffer(dst io.Writer, src io.Reader, bp *streamBackPressure) (int64, error) {
+	bufp := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(bufp)
+	buf := *bufp
+
+	var written int64
+	for {
+		limit := len(buf)
+		if bp != nil {
+			if err := bp.Wait(); err != nil {
+				return written, err
+			}
+			limit = bp.available(limit)
+		}
+		nr, er := src.Read(buf[:limit])
+		if nr > 0 {
+			if bp != nil {
+				bp.Update(nr)
+			}
+			nw, ew := dst.Write(buf[:nr])
+			if bp != nil {
+				bp.Update(-nr)
+			}
+			if nw < 0 || nr < nw {
+				nw = 0
+				if ew == nil {
+					ew = io.ErrShortWrite
+				}
+			}
+			written += int64(nw)
+			if ew != nil {
+				return written, ew
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er != nil {
+			if er == io.EOF {
+				return written, nil
+			}
+			return written, er
+		}
+	}
+}
+
+// ReadFrom 使用池化缓冲区将 r 的数据写入隧道，io.Copy 写入 connection 时使用
+func (c *connection) ReadFrom(r io.Reader) (int64, error) {
+	return copyBuffer(writerOnly{c}, r, nil)
+}
+
+// WriteTo 使用池化缓冲区将隧道的数据写入 w，io.Copy 读取 connection 时使用
+func (c *connection) WriteTo(w io.Writer) (int64, error) {
+	return copyBuffer(w, readerOnly{c}, nil)
+}
+
+// writerOnly 隐藏 ReadFrom，避免 copyBuffer 的调用方再次进入 ReadFrom
+type writerOnly struct {
+	io.Writer
+}
+
+// readerOnly 隐藏 WriteTo
+type readerOnly struct {
+	io.Reader
+}
+
+// pipeState 是 pipe 中两个方向共享的状态
+type pipeState struct {
+	client, server io.Closer
+	lastActive     atomic.Int64 // 最近一次转发数据的时间（UnixNano）
+	once           sync.Once
+	reason         closeReason
+}
+
+// terminate 以 reason 关闭两端连接，只有首次调用的原因生效，首次调用时返回 true
+func (p *pipeState) terminate(reason closeReason) (first bool) {
+	p.once.Do(func() {
+		first = true
+		p.reason = reason
+		closeConn(p.client, reason)
+		closeConn(p.server, reason)
+	})
+	return first
+}
+
+// aborter 由可以丢弃尚未发送的数据立即关闭的连接实现
+type aborter interface {
+	abort()
+}
+
+// closeConn 关闭 pipe 的一端，非正常关闭时丢弃尚未发送的数据，阻塞在写入上的协程立即返回
+func closeConn(c io.Closer, reason closeReason) {
+	if a, ok := c.(aborter); ok && reason != closeNormal {
+		a.abort()
+		return
+	}
+	_ = c.Close()
+}
+
+// touch 记录数据转发的时间
+func (p *pipeState) touch() {
+	p.lastActive.Store(time.Now().UnixNano())
+}
+
+// activityWriter 在每次写入数据后记录 pipe 的活动时间
+type activityWriter struct {
+	w io.Writer
+	p *pipeState
+}
+
+func (a *activityWriter) Write(p []byte) (int, error) {
+	n, err := a.w.Write(p)
+	if n > 0 {
+		a.p.touch()
+	}
+	return n, err
+}
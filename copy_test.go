@@ -0,0 +1,212 @@
+package rdialer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/midy177/webtransport-go"
+)
+
+// zeroReader 无限返回零字节
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// discardWriter 丢弃写入的数据，与 io.Discard 不同，没有 ReadFrom
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// pipeStream 是基于 net.Conn 的 webtransport.Stream，用于在测试中构造 connection
+type pipeStream struct {
+	webtransport.Stream
+	conn net.Conn
+}
+
+func (s pipeStream) Read(p []byte) (int, error)               { return s.conn.Read(p) }
+func (s pipeStream) Write(p []byte) (int, error)              { return s.conn.Write(p) }
+func (s pipeStream) Close() error                             { return s.conn.Close() }
+func (s pipeStream) CancelRead(webtransport.StreamErrorCode)  { _ = s.conn.Close() }
+func (s pipeStream) CancelWrite(webtransport.StreamErrorCode) { _ = s.conn.Close() }
+func (s pipeStream) SetDeadline(t time.Time) error            { return s.conn.SetDeadline(t) }
+func (s pipeStream) SetReadDeadline(t time.Time) error        { return s.conn.SetReadDeadline(t) }
+func (s pipeStream) SetWriteDeadline(t time.Time) error       { return s.conn.SetWriteDeadline(t) }
+
+// zeroStream 是读取 remaining 个零字节后返回 EOF、丢弃写入数据的 webtransport.Stream
+type zeroStream struct {
+	webtransport.Stream
+	remaining int64
+}
+
+func (s *zeroStream) Read(p []byte) (int, error) {
+	if s.remaining <= 0 {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), s.remaining)]
+	clear(p)
+	s.remaining -= int64(len(p))
+	return len(p), nil
+}
+
+func (s *zeroStream) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// newPipeConnection 返回基于 net.Pipe 的 connection 和对端
+func newPipeConnection() (*connection, net.Conn) {
+	local, remote := net.Pipe()
+	conn, _ := newConnection(pipeStream{conn: local}, "tcp", "bench", nil)
+	return conn, remote
+}
+
+// allocCounter 统计基准测试期间的内存分配次数，按每 GB 数据报告
+type allocCounter struct {
+	mallocs uint64
+}
+
+func startAllocCounter(b *testing.B) *allocCounter {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	b.ResetTimer()
+	return &allocCounter{mallocs: stats.Mallocs}
+}
+
+// report 以 bytesPerOp 计算每 GB 数据的分配次数
+func (a *allocCounter) report(b *testing.B, bytesPerOp int) {
+	b.StopTimer()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	total := float64(b.N) * float64(bytesPerOp)
+	b.ReportMetric(float64(stats.Mallocs-a.mallocs)/total*(1<<30), "allocs/GB")
+}
+
+// benchmarkPipe 通过一个 pipe 转发 b.N 次 size 字节的写入，统计从写入到目标端读完的吞吐量
+func benchmarkPipe(b *testing.B, size int) {
+	tunnel, app := newPipeConnection()
+	dialed, target := net.Pipe()
+	go pipe(tunnel, dialed, TunnelTimeouts{})
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(discardWriter{}, target)
+		received <- n
+	}()
+
+	buf := make([]byte, size)
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	allocs := startAllocCounter(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := app.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	_ = app.Close()
+	if n := <-received; n != int64(b.N)*int64(size) {
+		b.Fatalf("received %d bytes, want %d", n, int64(b.N)*int64(size))
+	}
+	allocs.report(b, size)
+}
+
+// benchmarkPipeTunnels 每次迭代建立一个新的 pipe 转发 size 字节后关闭，统计包含建立和关闭隧道的开销
+func benchmarkPipeTunnels(b *testing.B, size int) {
+	buf := make([]byte, size)
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	allocs := startAllocCounter(b)
+	for i := 0; i < b.N; i++ {
+		tunnel, app := newPipeConnection()
+		dialed, target := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			pipe(tunnel, dialed, TunnelTimeouts{})
+		}()
+		go func() {
+			_, _ = app.Write(buf)
+			_ = app.Close()
+		}()
+		if n, _ := io.Copy(discardWriter{}, target); n != int64(size) {
+			b.Fatalf("received %d bytes, want %d", n, size)
+		}
+		<-done
+	}
+	allocs.report(b, size)
+}
+
+func BenchmarkPipe(b *testing.B) {
+	for _, size := range []int{1 << 10, 16 << 10, 64 << 10} {
+		b.Run(fmt.Sprintf("stream/%dKiB", size>>10), func(b *testing.B) {
+			benchmarkPipe(b, size)
+		})
+	}
+	b.Run("tunnel/64KiB", func(b *testing.B) {
+		benchmarkPipeTunnels(b, 64<<10)
+	})
+}
+
+// BenchmarkConnection 统计 io.Copy 写入和读取 connection 的吞吐量，对应 ReadFrom 和 WriteTo
+func BenchmarkConnection(b *testing.B) {
+	const size = 1 << 20
+	b.Run("ReadFrom", func(b *testing.B) {
+		conn, _ := newConnection(&zeroStream{}, "tcp", "bench", nil)
+		b.ReportAllocs()
+		b.SetBytes(size)
+		allocs := startAllocCounter(b)
+		for i := 0; i < b.N; i++ {
+			if n, err := io.Copy(conn, &io.LimitedReader{R: zeroReader{}, N: size}); err != nil || n != size {
+				b.Fatalf("copied %d bytes: %v", n, err)
+			}
+		}
+		allocs.report(b, size)
+	})
+	b.Run("WriteTo", func(b *testing.B) {
+		stream := &zeroStream{}
+		conn, _ := newConnection(stream, "tcp", "bench", nil)
+		b.ReportAllocs()
+		b.SetBytes(size)
+		allocs := startAllocCounter(b)
+		for i := 0; i < b.N; i++ {
+			stream.remaining = size
+			if n, err := io.Copy(discardWriter{}, conn); err != nil || n != size {
+				b.Fatalf("copied %d bytes: %v", n, err)
+			}
+		}
+		allocs.report(b, size)
+	})
+}
+
+func BenchmarkCopyBuffer(b *testing.B) {
+	const size = 1 << 20
+	tests := []struct {
+		name string
+		copy func(dst io.Writer, src io.Reader) (int64, error)
+	}{
+		{name: "copyBuffer", copy: func(dst io.Writer, src io.Reader) (int64, error) {
+			return copyBuffer(dst, src, nil)
+		}},
+		{name: "io.Copy", copy: io.Copy},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(size)
+			allocs := startAllocCounter(b)
+			for i := 0; i < b.N; i++ {
+				src := &io.LimitedReader{R: zeroReader{}, N: size}
+				if n, err := tt.copy(discardWriter{}, src); err != nil || n != size {
+					b.Fatalf("copied %d bytes: %v", n, err)
+				}
+			}
+			allocs.report(b, size)
+		})
+	}
+}
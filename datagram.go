@@ -0,0 +1,162 @@
+package rdialer
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/midy177/webtransport-go"
+	"github.com/rs/zerolog/log"
+)
+
+// 数据报保活：开启后控制通道按保活间隔发送带序号的 QUIC 数据报探测代替 Ping，
+// 对端原样回显，发送方据此统计往返时延、抖动和丢包率。数据报不受流的队头阻塞影响，
+// 但可能被丢弃，探测未应答的间隔仍在控制通道上发送 Ping。
+// 未协商数据报或对端协议版本不支持时回退到控制通道上的 Ping。
+
+// datagramVersion 是支持数据报探测的最低协议版本
+const datagramVersion = 4
+
+// 探测数据报格式：1 字节类型 + 8 字节序号 + 8 字节发送方时间戳（UnixNano）
+const (
+	probeRequest byte = 1
+	probeReply   byte = 2
+	probeSize         = 17
+)
+
+// WithDatagramKeepalive 使服务端以 QUIC 数据报发送保活探测
+func WithDatagramKeepalive() ServerOption {
+	return func(s *Server) {
+		s.keepalive.datagram = true
+	}
+}
+
+// WithClientDatagramKeepalive 使客户端以 QUIC 数据报发送保活探测
+func WithClientDatagramKeepalive() ClientOption {
+	return func(c *Client) {
+		c.keepalive.datagram = true
+	}
+}
+
+// datagramProber 发送探测并统计应答
+type datagramProber struct {
+	send   func(b []byte) error // 发送一个数据报
+	remote string
+
+	mu       sync.Mutex
+	seq      uint64
+	pending  map[uint64]time.Time // 已发送未应答的探测
+	lastRTT  time.Duration
+	jitter   time.Duration // 相邻往返时延差值的平滑均值（RFC 3550）
+	lossRate float64       // 探测丢失率的指数加权均值
+}
+
+func newDatagramProber(session *webtransport.Session) *datagramProber {
+	return &datagramProber{
+		send:    session.SendDatagram,
+		remote:  session.RemoteAddr().String(),
+		pending: make(map[uint64]time.Time),
+	}
+}
+
+// probe 发送一个探测，超过 timeout 未应答的探测记为丢失
+func (p *datagramProber) probe(timeout time.Duration) {
+	now := time.Now()
+	p.mu.Lock()
+	for seq, sentAt := range p.pending {
+		if now.Sub(sentAt) > timeout {
+			delete(p.pending, seq)
+			p.lossRate += (1 - p.lossRate) / 16
+		}
+	}
+	p.seq++
+	seq := p.seq
+	p.pending[seq] = now
+	p.mu.Unlock()
+
+	buf := make([]byte, probeSize)
+	buf[0] = probeRequest
+	binary.BigEndian.PutUint64(buf[1:9], seq)
+	binary.BigEndian.PutUint64(buf[9:], uint64(now.UnixNano()))
+	if err := p.send(buf); err != nil {
+		// 发送失败按丢失处理，由失效判定决定会话去留
+		log.Debug().Str("RemoteAddr", p.remote).Err(err).Msg("send keepalive datagram")
+	}
+}
+
+// ack 记录探测应答，返回本次往返时延，重复或已判定丢失的应答返回 0
+func (p *datagramProber) ack(seq uint64, sentAt time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.pending[seq]; !ok {
+		return 0
+	}
+	delete(p.pending, seq)
+	rtt := time.Since(sentAt)
+	if p.lastRTT > 0 {
+		d := rtt - p.lastRTT
+		if d < 0 {
+			d = -d
+		}
+		p.jitter += (d - p.jitter) / 16
+	}
+	p.lastRTT = rtt
+	p.lossRate -= p.lossRate / 16
+	return rtt
+}
+
+// stats 返回抖动和丢包率
+func (p *datagramProber) stats() (time.Duration, float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.jitter, p.lossRate
+}
+
+// receiveDatagrams 回显对端的探测并记录本端探测的应答，任何探测数据报都视为对端存活，直到 ctx 结束
+func receiveDatagrams(ctx context.Context, session *webtransport.Session, cc *controlChannel) {
+	for {
+		buf, err := session.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		if len(buf) != probeSize {
+			continue
+		}
+		cc.lastSeen.Store(time.Now().UnixNano())
+		switch buf[0] {
+		case probeRequest:
+			reply := append([]byte(nil), buf...)
+			reply[0] = probeReply
+			_ = session.SendDatagram(reply)
+		case probeReply:
+			if cc.prober == nil {
+				continue
+			}
+			seq := binary.BigEndian.Uint64(buf[1:9])
+			sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(buf[9:])))
+			if rtt := cc.prober.ack(seq, sentAt); rtt > 0 {
+				cc.rtt.Store(int64(rtt))
+			}
+		}
+	}
+}
+
+// startDatagrams 在协商了数据报的会话上开始接收探测，开启数据报保活且对端版本支持时改用数据报探测
+func (cc *controlChannel) startDatagrams(ctx context.Context, session *webtransport.Session, peerVersion int) {
+	if !session.ConnectionState().SupportsDatagrams {
+		return
+	}
+	if cc.keepalive.datagram && peerVersion >= datagramVersion {
+		cc.prober = newDatagramProber(session)
+	}
+	go receiveDatagrams(ctx, session, cc)
+}
+
+// probeStats 返回数据报探测的抖动和丢包率，未使用数据报探测时返回零值
+func (cc *controlChannel) probeStats() (time.Duration, float64) {
+	if cc == nil || cc.prober == nil {
+		return 0, 0
+	}
+	return cc.prober.stats()
+}
@@ -1,30 +1,161 @@
 package rdialer
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"github.com/midy177/webtransport-go"
+	"github.com/quic-go/quic-go"
+	"io"
 	"net"
+	"sync/atomic"
 )
 
+// ErrStreamLimit 表示会话上同时打开的流已达到对端 MaxIncomingStreams 的限制，拨号立即失败而不是等待
+var ErrStreamLimit = errors.New("peer stream limit reached")
+
 type Dialer func(ctx context.Context, network, address string) (net.Conn, error)
 
-func toDialer(session *webtransport.Session, prefix string) Dialer {
+// sessionPicker 选择一个可用会话并返回对端的协议版本，exclude 中的会话已拨号失败，不应再次返回
+type sessionPicker func(ctx context.Context, exclude map[*webtransport.Session]bool) (*webtransport.Session, *streamStats, int, error)
+
+// liveDialer 返回绑定到会话选择器而非单个会话的拨号器，每次拨号都重新选择会话，
+// 当所选会话已关闭或达到对端流数限制导致打开流失败时换用其他会话重试，
+// 全部会话都达到流数限制时返回 ErrStreamLimit。timeouts 是本端配置的隧道超时
+func liveDialer(pick sessionPicker, prefix string, timeouts TunnelTimeouts) Dialer {
 	return func(ctx context.Context, proto, address string) (net.Conn, error) {
-		stream, err := session.OpenStream()
-		if err != nil {
-			return nil, err
-		}
-		if prefix == "" {
-			_, err := SendConnectMessage(stream, proto, address)
+		exclude := make(map[*webtransport.Session]bool)
+		limited := false
+		for {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			session, stats, version, err := pick(ctx, exclude)
 			if err != nil {
+				if limited {
+					return nil, ErrStreamLimit
+				}
 				return nil, err
 			}
-			return newConnection(stream, proto, address)
+			conn, err := dialSession(session, prefix, stats, version, dialOptionsFrom(ctx, timeouts), proto, address)
+			switch {
+			case err == nil:
+				return conn, nil
+			case errors.Is(err, ErrStreamLimit):
+				limited = true
+			case !isSessionClosed(session, err):
+				return nil, err
+			}
+			exclude[session] = true
+		}
+	}
+}
+
+// dialOptions 是单次拨号的选项，由拨号的 context 和本端配置合并得到
+type dialOptions struct {
+	timeouts   TunnelTimeouts
+	optimistic bool // Connect 消息与首次写入的数据合并发送
+	bandwidth  int  // 覆盖连接级别的带宽限制，0 表示使用本端配置
+}
+
+func dialOptionsFrom(ctx context.Context, timeouts TunnelTimeouts) dialOptions {
+	return dialOptions{
+		timeouts:   dialTimeoutsFrom(ctx).or(timeouts),
+		optimistic: optimisticFrom(ctx),
+		bandwidth:  dialBandwidthFrom(ctx),
+	}
+}
+
+// dialSession 在会话上打开一个流并发送 Connect 消息，设置了隧道超时或乐观拨号且对端版本支持时改为发送 ConnectEx 消息。
+// 乐观拨号时不立即发送，Connect 消息与首次写入的数据合并发送
+func dialSession(session *webtransport.Session, prefix string, stats *streamStats, version int, opts dialOptions, proto, address string) (net.Conn, error) {
+	if prefix != "" {
+		proto = prefix + "::" + proto
+	}
+	timeouts := opts.timeouts
+	awaitResult := opts.optimistic && version >= earlyDataVersion
+	writeHeader := func(w io.Writer) error {
+		if !awaitResult && (timeouts == (TunnelTimeouts{}) || version < tunnelOptionsVersion) {
+			_, err := SendConnectMessage(w, proto, address)
+			return err
 		}
-		_, err = SendConnectMessage(stream, prefix+"::"+proto, address)
+		data, err := json.Marshal(connectRequest{Proto: proto, Address: address, Timeouts: timeouts, Early: awaitResult})
+		if err != nil {
+			return err
+		}
+		_, err = NewEncodeBuffer(ConnectEx, data).WriteTo(w)
+		return err
+	}
+	if !opts.optimistic {
+		conn, err := openTunnel(session, stats, proto, address, writeHeader)
 		if err != nil {
 			return nil, err
 		}
-		return newConnection(stream, prefix+"::"+proto, address)
+		conn.setBandwidth(opts.bandwidth)
+		return conn, nil
+	}
+	var header bytes.Buffer
+	if err := writeHeader(&header); err != nil {
+		return nil, err
+	}
+	conn, err := openTunnel(session, stats, proto, address, func(io.Writer) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	conn.early = &earlyData{header: header.Bytes(), awaitResult: awaitResult}
+	conn.setBandwidth(opts.bandwidth)
+	return conn, nil
+}
+
+// connectRequest 是 ConnectEx 消息的消息体
+type connectRequest struct {
+	Proto    string         `json:"proto"`
+	Address  string         `json:"address"`
+	Timeouts TunnelTimeouts `json:"timeouts"`
+	// Early 为 true 时对端在转发数据前回复拨号结果
+	Early bool `json:"early,omitempty"`
+}
+
+// openTunnel 在会话上打开一个流，写入首个消息后将其包装为隧道连接
+func openTunnel(session *webtransport.Session, stats *streamStats, proto, address string, writeHeader func(w io.Writer) error) (*connection, error) {
+	stream, err := openStream(session)
+	if err != nil {
+		return nil, err
 	}
+	err = writeHeader(stream)
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	conn, err := newConnection(stream, proto, address, stats)
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	atomic.AddInt64(&stats.activeStreams, 1)
+	conn.onClose = func() {
+		atomic.AddInt64(&stats.activeStreams, -1)
+	}
+	stats.track(conn)
+	return conn, nil
+}
+
+// openStream 在会话上打开一个流，将对端流数限制错误转换为 ErrStreamLimit
+func openStream(session *webtransport.Session) (webtransport.Stream, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		var limitErr *quic.StreamLimitReachedError
+		if errors.As(err, &limitErr) {
+			return nil, ErrStreamLimit
+		}
+		return nil, err
+	}
+	return stream, nil
+}
+
+// isSessionClosed 判断拨号错误是否由会话关闭导致
+func isSessionClosed(session *webtransport.Session, err error) bool {
+	var sessionErr *webtransport.SessionError
+	return session.Context().Err() != nil || errors.As(err, &sessionErr)
 }
@@ -0,0 +1,111 @@
+package rdialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/midy177/webtransport-go"
+)
+
+// 会话关闭错误码，对端可以从 webtransport.SessionError 中读取错误码和原因
+const (
+	CodeNormal      webtransport.SessionErrorCode = 0
+	CodeReplaced    webtransport.SessionErrorCode = 1 // 被同一 clientKey 的新会话替换
+	CodeRejected    webtransport.SessionErrorCode = 2 // 未通过会话准入策略
+	CodeKicked      webtransport.SessionErrorCode = 3 // 被服务端主动断开
+	CodeQuarantined webtransport.SessionErrorCode = 4 // 被服务端断开并在一段时间内拒绝重连
+	CodeShutdown    webtransport.SessionErrorCode = 5 // 服务端关闭
+	// CodeKeepaliveTimeout 对端连续错过保活，会话被视为失效
+	CodeKeepaliveTimeout webtransport.SessionErrorCode = 6
+)
+
+// StatusQuarantined 是隔离期内重连被拒绝时返回的 HTTP 状态码，响应带有 Retry-After 头
+const StatusQuarantined = http.StatusLocked
+
+// QuarantinedError 表示客户端处于隔离期，RetryAfter 之后才能重连
+type QuarantinedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *QuarantinedError) Error() string {
+	return fmt.Sprintf("client quarantined, retry after %s", e.RetryAfter)
+}
+
+// DisconnectOption 配置 Server.Disconnect
+type DisconnectOption func(*disconnectOptions)
+
+type disconnectOptions struct {
+	quarantine time.Duration
+}
+
+// Quarantine 在断开后的 d 时间内拒绝该 clientKey 重连
+func Quarantine(d time.Duration) DisconnectOption {
+	return func(o *disconnectOptions) {
+		o.quarantine = d
+	}
+}
+
+// Disconnect 以 CodeKicked（设置隔离时为 CodeQuarantined）和 reason 关闭 clientKey 的全部会话，
+// 返回关闭的会话数
+func (s *Server) Disconnect(clientKey, reason string, options ...DisconnectOption) int {
+	var o disconnectOptions
+	for _, opt := range options {
+		opt(&o)
+	}
+	code := CodeKicked
+	if o.quarantine > 0 {
+		code = CodeQuarantined
+		s.sessions.quarantine(clientKey, time.Now().Add(o.quarantine))
+	}
+	return s.sessions.closeClient(clientKey, code, reason)
+}
+
+// Release 提前解除 clientKey 的隔离
+func (s *Server) Release(clientKey string) {
+	s.sessions.quarantined.Delete(clientKey)
+}
+
+// quarantine 设置 clientKey 的隔离截止时间
+func (sm *sessionManager) quarantine(clientKey string, until time.Time) {
+	sm.quarantined.Store(clientKey, until)
+}
+
+// quarantinedFor 返回 clientKey 剩余的隔离时间，未隔离时返回 0
+func (sm *sessionManager) quarantinedFor(clientKey string) time.Duration {
+	value, ok := sm.quarantined.Load(clientKey)
+	if !ok {
+		return 0
+	}
+	remaining := time.Until(value.(time.Time))
+	if remaining <= 0 {
+		sm.quarantined.CompareAndDelete(clientKey, value)
+		return 0
+	}
+	return remaining
+}
+
+// writeQuarantined 响应隔离期内的重连请求
+func (s *Server) writeQuarantined(w http.ResponseWriter, r *http.Request, remaining time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Round(time.Second)/time.Second)+1))
+	s.errorWriter(w, r, StatusQuarantined, &QuarantinedError{RetryAfter: remaining})
+}
+
+// sessionCloseError 返回已关闭会话的关闭原因，会话仍然存活时返回 nil
+func sessionCloseError(session *webtransport.Session) *webtransport.SessionError {
+	select {
+	case <-session.Context().Done():
+	default:
+		return nil
+	}
+	// 会话关闭后 AcceptStream 立即返回关闭原因
+	_, err := session.AcceptStream(context.Background())
+	var sessionErr *webtransport.SessionError
+	if errors.As(err, &sessionErr) {
+		return sessionErr
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package rdialer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/midy177/webtransport-go"
+)
+
+// earlyDataVersion 是支持对端在转发数据前回复拨号结果的最低协议版本
+const earlyDataVersion = 6
+
+var errNoConnectResult = errors.New("tunnel closed before connect result")
+
+// RemoteDialError 表示乐观拨号时对端拨号目标地址失败，在首次读取时返回
+type RemoteDialError struct {
+	Network string
+	Address string
+	Message string
+}
+
+func (e *RemoteDialError) Error() string {
+	return fmt.Sprintf("remote dial %s %s: %s", e.Network, e.Address, e.Message)
+}
+
+type optimisticCtxKey struct{}
+
+// WithOptimisticDial 使单次拨号在打开流后立即返回，不等待 Connect 消息发出：
+// Connect 消息与首次写入的数据合并发送，对端拨号成功后再转发这些数据。
+// 对端协议版本支持时，对端在转发数据前回复拨号结果，拨号失败在首次读取时以 RemoteDialError 返回
+func WithOptimisticDial(ctx context.Context) context.Context {
+	return context.WithValue(ctx, optimisticCtxKey{}, true)
+}
+
+func optimisticFrom(ctx context.Context) bool {
+	optimistic, _ := ctx.Value(optimisticCtxKey{}).(bool)
+	return optimistic
+}
+
+// earlyData 是乐观拨号的连接中尚未发送的 Connect 消息和尚未读取的拨号结果
+type earlyData struct {
+	mu     sync.Mutex
+	header []byte // 尚未发送的 Connect 消息，与首次写入合并发送
+	sent   atomic.Bool
+
+	awaitResult bool // 对端在转发数据前回复拨号结果
+	resultMu    sync.Mutex
+	resultDone  bool
+	resultErr   error
+	partial     []byte // 读取截止时间到达前已读取的不完整拨号结果
+}
+
+// write 将尚未发送的 Connect 消息与 p 合并写入流，返回 p 中已写入的字节数
+func (e *earlyData) write(stream webtransport.Stream, p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.sent.Load() {
+		return stream.Write(p)
+	}
+	header := e.header
+	n, err := stream.Write(append(header, p...))
+	e.header = nil
+	e.sent.Store(true)
+	return max(n-len(header), 0), err
+}
+
+// flush 单独发送尚未发送的 Connect 消息，用于首次读取先于首次写入的情况
+func (e *earlyData) flush(stream webtransport.Stream) error {
+	if e.sent.Load() {
+		return nil
+	}
+	_, err := e.write(stream, nil)
+	return err
+}
+
+// result 读取对端回复的拨号结果，只在首次成功读取或确定失败后返回相同的结果。
+// 读取截止时间到达时不记录结果，已读取的部分保留到下次读取时继续解析
+func (e *earlyData) result(stream webtransport.Stream, network, address string) error {
+	if !e.awaitResult {
+		return nil
+	}
+	e.resultMu.Lock()
+	defer e.resultMu.Unlock()
+	if e.resultDone {
+		return e.resultErr
+	}
+	var read bytes.Buffer
+	decodeBuffer := NewDecodeBuffer()
+	_, err := decodeBuffer.ReadFrom(io.MultiReader(bytes.NewReader(e.partial), io.TeeReader(stream, &read)))
+	switch {
+	case isTimeout(err):
+		e.partial = append(e.partial, read.Bytes()...)
+		return err
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		err = errNoConnectResult
+	case err == nil && decodeBuffer.MessageType != ConnectResult:
+		err = fmt.Errorf("unexpected message type %d, want connect result", decodeBuffer.MessageType)
+	case err == nil && len(decodeBuffer.Buffer) > 0:
+		err = &RemoteDialError{Network: network, Address: address, Message: string(decodeBuffer.Buffer)}
+	}
+	e.resultDone, e.resultErr, e.partial = true, err, nil
+	return err
+}
+
+// sendConnectResult 向拨号端回复拨号结果，消息体为空表示成功，否则为错误信息
+func sendConnectResult(w io.Writer, dialErr error) error {
+	var data []byte
+	if dialErr != nil {
+		data = []byte(dialErr.Error())
+	}
+	_, err := NewEncodeBuffer(ConnectResult, data).WriteTo(w)
+	return err
+}
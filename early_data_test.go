@@ -0,0 +1,136 @@
+package rdialer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/midy177/webtransport-go"
+)
+
+// bufferStream 是读写内存缓冲区的 webtransport.Stream，只实现 Read 和 Write
+type bufferStream struct {
+	webtransport.Stream
+	in  bytes.Buffer // Read 读取的数据
+	out bytes.Buffer // Write 写入的数据
+}
+
+func (s *bufferStream) Read(p []byte) (int, error)  { return s.in.Read(p) }
+func (s *bufferStream) Write(p []byte) (int, error) { return s.out.Write(p) }
+
+func TestEarlyDataWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		flush  bool // 首次写入前单独发送 Connect 消息
+		writes []string
+		want   string
+	}{
+		{name: "header merged with first write", writes: []string{"hello", " world"}, want: "HDRhello world"},
+		{name: "flush before write", flush: true, writes: []string{"hello"}, want: "HDRhello"},
+		{name: "flush only", flush: true, want: "HDR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &bufferStream{}
+			e := &earlyData{header: []byte("HDR")}
+			if tt.flush {
+				if err := e.flush(stream); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, w := range tt.writes {
+				if n, err := e.write(stream, []byte(w)); err != nil || n != len(w) {
+					t.Fatalf("write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if got := stream.out.String(); got != tt.want {
+				t.Fatalf("stream got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEarlyDataResult(t *testing.T) {
+	frame := func(t MessageType, payload string) []byte {
+		var buf bytes.Buffer
+		_, _ = NewEncodeBuffer(t, []byte(payload)).WriteTo(&buf)
+		return buf.Bytes()
+	}
+	var dialErr *RemoteDialError
+	tests := []struct {
+		name  string
+		reply []byte
+		check func(err error) bool
+	}{
+		{name: "success", reply: frame(ConnectResult, ""), check: func(err error) bool { return err == nil }},
+		{name: "remote dial error", reply: frame(ConnectResult, "connection refused"), check: func(err error) bool {
+			return errors.As(err, &dialErr) && dialErr.Message == "connection refused" && dialErr.Address == "127.0.0.1:1"
+		}},
+		{name: "closed before result", reply: nil, check: func(err error) bool { return errors.Is(err, errNoConnectResult) }},
+		{name: "truncated result", reply: frame(ConnectResult, "refused")[:6], check: func(err error) bool { return errors.Is(err, errNoConnectResult) }},
+		{name: "unexpected message", reply: frame(KeepAlive, ""), check: func(err error) bool { return err != nil && dialErr == nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialErr = nil
+			stream := &bufferStream{}
+			stream.in.Write(tt.reply)
+			e := &earlyData{awaitResult: true}
+			err := e.result(stream, "tcp", "127.0.0.1:1")
+			if !tt.check(err) {
+				t.Fatalf("result = %v", err)
+			}
+			// 结果只读取一次，之后返回相同的结果
+			if again := e.result(stream, "tcp", "127.0.0.1:1"); again != err {
+				t.Fatalf("second result = %v, want %v", again, err)
+			}
+		})
+	}
+	if err := (&earlyData{}).result(&bufferStream{}, "tcp", "127.0.0.1:1"); err != nil {
+		t.Fatalf("result without awaitResult = %v", err)
+	}
+}
+
+// timeoutStream 依次返回 chunks 中的数据，每段之间返回一次读取超时
+type timeoutStream struct {
+	webtransport.Stream
+	chunks  [][]byte
+	timeout bool // 下次读取返回超时
+}
+
+func (s *timeoutStream) Read(p []byte) (int, error) {
+	if s.timeout {
+		s.timeout = false
+		return 0, os.ErrDeadlineExceeded
+	}
+	if len(s.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, s.chunks[0])
+	if s.chunks[0] = s.chunks[0][n:]; len(s.chunks[0]) == 0 {
+		s.chunks = s.chunks[1:]
+		s.timeout = true
+	}
+	return n, nil
+}
+
+func TestEarlyDataResultTimeout(t *testing.T) {
+	var frame bytes.Buffer
+	_, _ = NewEncodeBuffer(ConnectResult, []byte("connection refused")).WriteTo(&frame)
+	// 截止时间分别在长度字段中间和消息体中间到达
+	b := frame.Bytes()
+	stream := &timeoutStream{chunks: [][]byte{b[:2], b[2:8], b[8:]}}
+	e := &earlyData{awaitResult: true}
+
+	for i := 0; i < 2; i++ {
+		if err := e.result(stream, "tcp", "127.0.0.1:1"); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("result %d = %v, want deadline exceeded", i, err)
+		}
+	}
+	var dialErr *RemoteDialError
+	if err := e.result(stream, "tcp", "127.0.0.1:1"); !errors.As(err, &dialErr) || dialErr.Message != "connection refused" {
+		t.Fatalf("result after timeouts = %v, want the remote dial error", err)
+	}
+}
@@ -13,6 +13,27 @@ type MessageType uint8
 const (
 	Connect MessageType = iota + 1
 	KeepAlive
+	// Announce 集群节点间周期性通告本节点持有的 clientKey
+	Announce
+	// Forward 集群节点间转发发往其他节点所持有客户端的拨号
+	Forward
+	// GoAway 服务端即将关闭，要求客户端重连到其他服务端并停止在该会话上发起新的流
+	GoAway
+	// Migrate 服务端要求客户端迁移到消息体中的服务端地址，随保活应答发送
+	Migrate
+	// Control 打开控制通道的首帧，之后的帧均为控制消息
+	Control
+	PingMessage
+	PongMessage
+	LabelUpdateMessage
+	PolicyMessage
+	ReAuthRequestMessage
+	ReAuthResponseMessage
+	ErrorMessage
+	// ConnectEx 携带隧道超时等选项的 Connect，消息体为 JSON
+	ConnectEx
+	// ConnectResult 乐观拨号时对端回复的拨号结果，消息体为空表示成功，否则为错误信息
+	ConnectResult
 )
 
 var (
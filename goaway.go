@@ -0,0 +1,196 @@
+package rdialer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/midy177/webtransport-go"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errServerDraining   = errors.New("server is shutting down")
+	errGoAway           = errors.New("server sent GOAWAY")
+	errNoControlChannel = errors.New("no session with control channel")
+)
+
+const (
+	// shutdownPollInterval 是 Shutdown 检查隧道连接是否全部结束的间隔
+	shutdownPollInterval = 100 * time.Millisecond
+	// goAwayGracePeriod 是隧道连接结束后等待客户端自行关闭会话的最长时间，确保 GOAWAY 在关闭连接前送达
+	goAwayGracePeriod = time.Second
+)
+
+// Shutdown 优雅关闭服务器：拒绝新会话，向所有客户端发送 GOAWAY 让其重连到其他服务端并停止在本会话上发起新的流，
+// 等待进行中的隧道连接结束后以 CodeShutdown 关闭所有会话；ctx 到期时强制关闭所有会话并返回 ctx.Err()。
+// 与 http.Server.Shutdown 相同，再次调用时只等待首次调用结束，其 ctx 到期时返回 ctx.Err() 而不强制关闭
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !s.draining.CompareAndSwap(false, true) {
+		select {
+		case <-s.drained:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer close(s.drained)
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return nil
+	}
+
+	n := s.sessions.goAway(ctx, "server shutting down")
+	log.Info().Int("Sessions", n).Msg("Server draining, GOAWAY sent")
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		tunnels := s.sessions.activeTunnels()
+		if tunnels == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			log.Warn().Int("Tunnels", tunnels).Msg("Shutdown deadline exceeded, force closing sessions")
+			_ = s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	// 客户端收到 GOAWAY 后在隧道连接结束时自行关闭会话，稍等片刻以免关闭连接时丢弃尚未发出的 GOAWAY
+	s.sessions.waitSessionsClosed(ctx, goAwayGracePeriod)
+	return s.Close()
+}
+
+// goAway 向全部会话发送 GOAWAY，等待全部发送完成或 ctx 到期，返回发送的会话数
+func (sm *sessionManager) goAway(ctx context.Context, reason string) int {
+	var sessions []*serverSession
+	sm.clients.Range(func(_, value any) bool {
+		cs := value.(*clientSessions)
+		cs.mu.Lock()
+		sessions = append(sessions, cs.sessions...)
+		cs.mu.Unlock()
+		return true
+	})
+	var wg sync.WaitGroup
+	for _, ss := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ss.sendGoAway(reason)
+		}()
+	}
+	sent := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-ctx.Done():
+	}
+	return len(sessions)
+}
+
+// sendGoAway 发送 GOAWAY 消息，已建立控制通道的会话经控制通道发送，否则在新打开的流上发送，消息体为原因
+func (ss *serverSession) sendGoAway(reason string) {
+	if cc := ss.control.Load(); cc != nil {
+		if err := cc.send(GoAwayNotice{Reason: reason}); err != nil {
+			log.Warn().Str("ClientKey", ss.clientKey).Err(err).Msg("send GOAWAY failed")
+		}
+		return
+	}
+	stream, err := ss.session.OpenStream()
+	if err != nil {
+		log.Warn().Str("ClientKey", ss.clientKey).Err(err).Msg("open GOAWAY stream failed")
+		return
+	}
+	defer stream.Close()
+	if _, err := NewEncodeBuffer(GoAway, []byte(reason)).WriteTo(stream); err != nil {
+		log.Warn().Str("ClientKey", ss.clientKey).Err(err).Msg("send GOAWAY failed")
+	}
+}
+
+// activeTunnels 返回全部会话上进行中的隧道连接数
+func (sm *sessionManager) activeTunnels() int {
+	var n int
+	sm.clients.Range(func(_, value any) bool {
+		cs := value.(*clientSessions)
+		cs.mu.Lock()
+		for _, ss := range cs.sessions {
+			if ss.session.Context().Err() != nil {
+				continue
+			}
+			ss.stats.tunnels.Range(func(_, _ any) bool {
+				n++
+				return true
+			})
+		}
+		cs.mu.Unlock()
+		return true
+	})
+	return n
+}
+
+// waitSessionsClosed 等待全部会话关闭，最多等待 timeout，ctx 到期时立即返回
+func (sm *sessionManager) waitSessionsClosed(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for sm.openSessions() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// openSessions 返回尚未关闭的会话数
+func (sm *sessionManager) openSessions() int {
+	var n int
+	sm.clients.Range(func(_, value any) bool {
+		cs := value.(*clientSessions)
+		cs.mu.Lock()
+		for _, ss := range cs.sessions {
+			if ss.session.Context().Err() == nil {
+				n++
+			}
+		}
+		cs.mu.Unlock()
+		return true
+	})
+	return n
+}
+
+// goAwayState 记录客户端会话是否收到了 GOAWAY
+type goAwayState struct {
+	received atomic.Bool
+	ch       chan struct{}
+}
+
+func newGoAwayState() *goAwayState {
+	return &goAwayState{ch: make(chan struct{})}
+}
+
+// handler 返回处理 GOAWAY 消息的 messageHandler
+func (g *goAwayState) handler(remote string) messageHandler {
+	return func(_ webtransport.Stream, payload []byte) {
+		g.trigger(remote, string(payload))
+	}
+}
+
+// trigger 记录收到的 GOAWAY，重复的 GOAWAY 被忽略
+func (g *goAwayState) trigger(remote, reason string) {
+	if g.received.CompareAndSwap(false, true) {
+		log.Info().Str("RemoteAddr", remote).Str("Reason", reason).Msg("received GOAWAY from server")
+		close(g.ch)
+	}
+}
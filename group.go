@@ -0,0 +1,95 @@
+package rdialer
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/midy177/webtransport-go"
+)
+
+type routingKeyCtxKey struct{}
+
+// WithRoutingKey 为拨号设置路由键，组拨号器据此将相同路由键的连接固定到同一组成员
+func WithRoutingKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, routingKeyCtxKey{}, key)
+}
+
+func routingKeyFrom(ctx context.Context) string {
+	key, _ := ctx.Value(routingKeyCtxKey{}).(string)
+	return key
+}
+
+// getGroupDialer 返回绑定到客户端组的拨号器
+func (sm *sessionManager) getGroupDialer(group string) (Dialer, error) {
+	if _, err := sm.pickByGroup(context.Background(), group, nil); err != nil {
+		return nil, err
+	}
+	return sm.dialer(func(ctx context.Context, exclude map[*webtransport.Session]bool) (*serverSession, error) {
+		return sm.pickByGroup(ctx, group, exclude)
+	}), nil
+}
+
+// pickByGroup 在组内优先级最高且仍有健康会话的成员中选择会话。
+// ctx 携带路由键时使用最高随机权重哈希（rendezvous hashing）固定到其中一个成员，
+// 成员下线后只有原先路由到该成员的路由键会迁移。
+func (sm *sessionManager) pickByGroup(ctx context.Context, group string, exclude map[*webtransport.Session]bool) (*serverSession, error) {
+	var candidates []*serverSession
+	sm.clients.Range(func(_, value any) bool {
+		cs := value.(*clientSessions)
+		cs.mu.Lock()
+		for _, s := range cs.sessions {
+			if s.group != group || exclude[s.session] || s.session.Context().Err() != nil {
+				continue
+			}
+			if len(candidates) > 0 && s.priority < candidates[0].priority {
+				continue
+			}
+			if len(candidates) > 0 && s.priority > candidates[0].priority {
+				candidates = candidates[:0]
+			}
+			candidates = append(candidates, s)
+		}
+		cs.mu.Unlock()
+		return true
+	})
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("group %s has no active members", group)
+	}
+
+	if routingKey := routingKeyFrom(ctx); routingKey != "" {
+		member := stickyMember(routingKey, candidates)
+		sticky := candidates[:0:0]
+		for _, s := range candidates {
+			if s.clientKey == member {
+				sticky = append(sticky, s)
+			}
+		}
+		candidates = sticky
+	}
+
+	list := make([]Candidate, len(candidates))
+	for i, s := range candidates {
+		list[i] = s
+	}
+	return pickCandidate(sm.balancer, "group:"+group, list)
+}
+
+// stickyMember 返回路由键哈希权重最高的成员 clientKey
+func stickyMember(routingKey string, candidates []*serverSession) string {
+	var (
+		member string
+		best   uint64
+	)
+	for _, s := range candidates {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(routingKey))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(s.clientKey))
+		if sum := h.Sum64(); member == "" || sum > best {
+			member, best = s.clientKey, sum
+		}
+	}
+	return member
+}
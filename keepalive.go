@@ -0,0 +1,64 @@
+package rdialer
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultKeepaliveInterval 是默认的保活间隔
+	DefaultKeepaliveInterval = 3 * time.Second
+	// DefaultKeepaliveMisses 是默认允许连续错过的保活次数，超过后会话被视为失效
+	DefaultKeepaliveMisses = 3
+
+	// legacyKeepaliveInterval 是旧版本客户端固定的保活间隔
+	legacyKeepaliveInterval = 3 * time.Second
+)
+
+var errKeepaliveTimeout = errors.New("keepalive timeout")
+
+// keepaliveConfig 是保活间隔和失效判定阈值
+type keepaliveConfig struct {
+	interval  time.Duration
+	maxMissed int
+	datagram  bool // 以 QUIC 数据报发送保活探测
+}
+
+// withDefaults 用默认值填充未设置的字段
+func (k keepaliveConfig) withDefaults() keepaliveConfig {
+	if k.interval <= 0 {
+		k.interval = DefaultKeepaliveInterval
+	}
+	if k.maxMissed <= 0 {
+		k.maxMissed = DefaultKeepaliveMisses
+	}
+	return k
+}
+
+// timeout 返回 interval 间隔下判定会话失效所需的静默时长
+func (k keepaliveConfig) timeout(interval time.Duration) time.Duration {
+	return interval * time.Duration(k.maxMissed)
+}
+
+// WithKeepalive 设置服务端的保活间隔，以及连续多少个间隔未收到客户端的任何保活消息后驱逐会话
+func WithKeepalive(interval time.Duration, maxMissed int) ServerOption {
+	return func(s *Server) {
+		s.keepalive.interval, s.keepalive.maxMissed = interval, maxMissed
+	}
+}
+
+// WithClientKeepalive 设置客户端的保活间隔，以及连续多少个间隔未收到服务端的任何消息后放弃会话并故障转移
+func WithClientKeepalive(interval time.Duration, maxMissed int) ClientOption {
+	return func(c *Client) {
+		c.keepalive.interval, c.keepalive.maxMissed = interval, maxMissed
+	}
+}
+
+// evict 关闭保活超时的会话，会话的处理循环随之退出并从会话管理器中移除
+func (ss *serverSession) evict() {
+	log.Warn().Str("ClientKey", ss.clientKey).Str("RemoteAddr", ss.session.RemoteAddr().String()).
+		Msg("keepalive timeout, evicting session")
+	_ = ss.session.CloseWithError(CodeKeepaliveTimeout, errKeepaliveTimeout.Error())
+}
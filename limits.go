@@ -0,0 +1,159 @@
+package rdialer
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ClientLimits 定义单个 clientKey 的配额，由该客户端的全部会话共享，零值字段使用服务端默认值
+type ClientLimits struct {
+	MaxSessions    int     `json:"maxSessions,omitempty"`    // 同时保持的会话数上限，覆盖 SessionPolicy.MaxSessions
+	StreamRate     float64 `json:"streamRate,omitempty"`     // 每秒接受的新隧道连接数，覆盖 RateLimit
+	StreamBurst    int     `json:"streamBurst,omitempty"`    // 新流的突发数，覆盖 RateBurst
+	MaxStreams     int     `json:"maxStreams,omitempty"`     // 同时处理的客户端打开的隧道连接数上限，默认不限制
+	BytesPerSecond int     `json:"bytesPerSecond,omitempty"` // 全部隧道连接每秒读写的字节数上限，覆盖 BandwidthLimits.PerClient
+}
+
+// clientQuota 是单个 clientKey 在全部会话间共享的配额状态
+type clientQuota struct {
+	streams *rate.Limiter // 新流速率
+	active  *handlerLimit // 同时处理的流数
+	bytes   *rate.Limiter // 隧道连接的字节速率
+	// sessions 是使用该配额的会话数，由 sessionManager.quotaMu 保护
+	sessions int
+	// dropTimer 在令牌桶回满后删除空闲的配额，由 sessionManager.quotaMu 保护
+	dropTimer *time.Timer
+}
+
+func newClientQuota(limits ClientLimits, defaultBytesPerSecond int) *clientQuota {
+	q := &clientQuota{
+		streams: newSessionLimiter(),
+		active:  &handlerLimit{},
+		bytes:   newByteLimiter(0),
+	}
+	q.apply(limits, defaultBytesPerSecond)
+	return q
+}
+
+// apply 将 limits 应用到配额，未设置的字段恢复默认值
+func (q *clientQuota) apply(limits ClientLimits, defaultBytesPerSecond int) {
+	if limits.StreamRate > 0 {
+		q.streams.SetLimit(rate.Limit(limits.StreamRate))
+	} else {
+		q.streams.SetLimit(rate.Limit(RateLimit))
+	}
+	if limits.StreamBurst > 0 {
+		q.streams.SetBurst(limits.StreamBurst)
+	} else {
+		q.streams.SetBurst(RateBurst)
+	}
+	q.active.max.Store(int64(limits.MaxStreams))
+	if limits.BytesPerSecond > 0 {
+		setByteRate(q.bytes, limits.BytesPerSecond)
+	} else {
+		setByteRate(q.bytes, defaultBytesPerSecond)
+	}
+}
+
+// refillDelay 返回配额的令牌桶全部回满所需的时间，回满之后删除配额再重新创建不会改变客户端的可用配额
+func (q *clientQuota) refillDelay(now time.Time) time.Duration {
+	return max(refillDelay(q.streams, now), refillDelay(q.bytes, now))
+}
+
+// refillDelay 返回 limiter 回满到突发量所需的时间
+func refillDelay(limiter *rate.Limiter, now time.Time) time.Duration {
+	limit := limiter.Limit()
+	if limit == rate.Inf || limit <= 0 {
+		return 0
+	}
+	missing := float64(limiter.Burst()) - limiter.TokensAt(now)
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / float64(limit) * float64(time.Second))
+}
+
+// limitsFor 返回 clientKey 的限制覆盖，未设置时返回零值
+func (sm *sessionManager) limitsFor(clientKey string) ClientLimits {
+	if value, ok := sm.limits.Load(clientKey); ok {
+		return value.(ClientLimits)
+	}
+	return ClientLimits{}
+}
+
+// maxSessionsFor 返回 clientKey 生效的会话数上限
+func (sm *sessionManager) maxSessionsFor(clientKey string) int {
+	if limits := sm.limitsFor(clientKey); limits.MaxSessions > 0 {
+		return limits.MaxSessions
+	}
+	return sm.policy.MaxSessions
+}
+
+// acquireQuota 返回 clientKey 的共享配额并记录一个使用它的会话，首次使用时按生效的限制创建。
+// 客户端的会话和隧道连接全部结束后，配额保留到令牌桶回满为止，断开后重连不会重置已消耗的配额
+func (sm *sessionManager) acquireQuota(clientKey string) *clientQuota {
+	sm.quotaMu.Lock()
+	defer sm.quotaMu.Unlock()
+	q, ok := sm.quotas[clientKey]
+	if !ok {
+		q = newClientQuota(sm.limitsFor(clientKey), sm.bandwidthPerClient)
+		q.active.idle = func() { sm.dropQuota(clientKey, q) }
+		sm.quotas[clientKey] = q
+	}
+	q.sessions++
+	return q
+}
+
+// releaseQuota 在会话移除时调用，与 acquireQuota 成对使用
+func (sm *sessionManager) releaseQuota(clientKey string, q *clientQuota) {
+	sm.quotaMu.Lock()
+	q.sessions--
+	sm.quotaMu.Unlock()
+	sm.dropQuota(clientKey, q)
+}
+
+// dropQuota 在客户端没有会话且没有隧道连接时删除配额，避免配额表随出现过的 clientKey 无限增长。
+// 令牌桶尚未回满时推迟到回满之后再删除
+func (sm *sessionManager) dropQuota(clientKey string, q *clientQuota) {
+	sm.quotaMu.Lock()
+	defer sm.quotaMu.Unlock()
+	if q.sessions != 0 || q.active.active.Load() != 0 || sm.quotas[clientKey] != q {
+		return
+	}
+	if delay := q.refillDelay(time.Now()); delay > 0 {
+		if q.dropTimer == nil {
+			q.dropTimer = time.AfterFunc(delay, func() { sm.dropQuota(clientKey, q) })
+		} else {
+			q.dropTimer.Reset(delay)
+		}
+		return
+	}
+	delete(sm.quotas, clientKey)
+}
+
+// setLimits 更新 clientKey 的限制并立即应用到共享配额
+func (sm *sessionManager) setLimits(clientKey string, limits ClientLimits) {
+	if limits == (ClientLimits{}) {
+		sm.limits.Delete(clientKey)
+	} else {
+		sm.limits.Store(clientKey, limits)
+	}
+	sm.quotaMu.Lock()
+	defer sm.quotaMu.Unlock()
+	if q, ok := sm.quotas[clientKey]; ok {
+		q.apply(limits, sm.bandwidthPerClient)
+	}
+}
+
+// ClientLimits 返回 clientKey 当前的限制覆盖
+func (s *Server) ClientLimits(clientKey string) ClientLimits {
+	return s.sessions.limitsFor(clientKey)
+}
+
+// SetClientLimits 在运行时更新 clientKey 的限制，传入零值恢复默认值。
+// 速率和并发流数的变化立即作用于该客户端的全部会话，会话数上限作用于之后建立的会话。
+// 带宽从不限制改为限制时只作用于之后建立的隧道连接，建立时已有客户端带宽限制的连接立即按新速率整形
+func (s *Server) SetClientLimits(clientKey string, limits ClientLimits) {
+	s.sessions.setLimits(clientKey, limits)
+}
@@ -0,0 +1,146 @@
+package rdialer
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQuotaDroppedWhenIdle(t *testing.T) {
+	tests := []struct {
+		name     string
+		sessions int  // 获取配额的会话数
+		released int  // 已移除的会话数
+		tunnel   bool // 最后一个会话移除时是否仍有隧道连接
+		want     bool // 配额是否仍保留
+	}{
+		{name: "live session", sessions: 1, released: 0, want: true},
+		{name: "last session removed", sessions: 1, released: 1, want: false},
+		{name: "one of two removed", sessions: 2, released: 1, want: true},
+		{name: "tunnel outlives session", sessions: 1, released: 1, tunnel: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newSessionManager()
+			var q *clientQuota
+			for i := 0; i < tt.sessions; i++ {
+				q = sm.acquireQuota("k")
+			}
+			if tt.tunnel && !q.active.acquire() {
+				t.Fatal("acquire failed")
+			}
+			for i := 0; i < tt.released; i++ {
+				sm.releaseQuota("k", q)
+			}
+			if tt.tunnel {
+				if _, ok := sm.quotas["k"]; !ok {
+					t.Fatal("quota dropped while a tunnel is active")
+				}
+				q.active.release()
+			}
+			if _, ok := sm.quotas["k"]; ok != tt.want {
+				t.Fatalf("quota kept = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaSharedAcrossReconnect(t *testing.T) {
+	sm := newSessionManager()
+	first := sm.acquireQuota("k")
+	second := sm.acquireQuota("k")
+	if first != second {
+		t.Fatal("sessions of one client got different quotas")
+	}
+	sm.releaseQuota("k", first)
+	if third := sm.acquireQuota("k"); third != second {
+		t.Fatal("quota reset while the client still had a session")
+	}
+}
+
+// TestQuotaSharedAcrossSessions 按服务端的方式为同一 clientKey 的两个会话创建 streamAdmitter，
+// 并发流数和新流速率都由两个会话共享，其他客户端不受影响
+func TestQuotaSharedAcrossSessions(t *testing.T) {
+	sm := newSessionManager()
+	sm.setLimits("k", ClientLimits{StreamRate: 0.001, StreamBurst: 2, MaxStreams: 1})
+	addr := &net.TCPAddr{}
+	newSession := func(clientKey string) (streamAdmitter, *streamStats) {
+		q := sm.acquireQuota(clientKey)
+		concurrency := newConcurrencyLimits(0, 0)
+		concurrency.client = q.active
+		stats := &streamStats{}
+		return newStreamAdmitter(clientKey, addr, stats, q.streams, concurrency), stats
+	}
+	first, _ := newSession("k")
+	second, secondStats := newSession("k")
+	other, _ := newSession("other")
+
+	release, ok := first(&resetStream{})
+	if !ok {
+		t.Fatal("first stream rejected")
+	}
+	if _, ok := second(&resetStream{}); ok {
+		t.Fatal("second session exceeded the client's MaxStreams")
+	}
+	if secondStats.rejected != 1 {
+		t.Fatalf("second session rejected = %d, want 1", secondStats.rejected)
+	}
+	if release, ok := other(&resetStream{}); !ok {
+		t.Fatal("another client limited by k's quota")
+	} else {
+		release()
+	}
+	release()
+
+	// 并发名额归还后第二个会话可以接受新流，消耗的令牌同样是共享的
+	release, ok = second(&resetStream{})
+	if !ok {
+		t.Fatal("second session rejected after the stream was released")
+	}
+	release()
+	if _, ok := first(&resetStream{}); ok {
+		t.Fatal("first session got a token beyond the shared burst")
+	}
+
+	// 运行时调整的限制同时作用于两个会话
+	sm.setLimits("k", ClientLimits{StreamRate: 1000, StreamBurst: 10, MaxStreams: 2})
+	waitFor(t, "stream tokens refilled", func() bool { return sm.quotas["k"].streams.Tokens() >= 2 })
+	releaseFirst, okFirst := first(&resetStream{})
+	releaseSecond, okSecond := second(&resetStream{})
+	if !okFirst || !okSecond {
+		t.Fatalf("streams after raising limits accepted = %v, %v, want both", okFirst, okSecond)
+	}
+	if _, ok := first(&resetStream{}); ok {
+		t.Fatal("third concurrent stream accepted with MaxStreams 2")
+	}
+	releaseFirst()
+	releaseSecond()
+}
+
+func TestQuotaKeptUntilRefilled(t *testing.T) {
+	sm := newSessionManager()
+	sm.setLimits("k", ClientLimits{StreamRate: 50, StreamBurst: 5})
+	q := sm.acquireQuota("k")
+	if !q.streams.AllowN(time.Now(), 5) {
+		t.Fatal("burst not available")
+	}
+	sm.releaseQuota("k", q)
+
+	// 断开后立即重连，拿到的仍是已消耗突发量的配额
+	again := sm.acquireQuota("k")
+	if again != q {
+		t.Fatal("quota reset by reconnecting")
+	}
+	if tokens := again.streams.Tokens(); tokens >= 5 {
+		t.Fatalf("reconnected client has %.1f stream tokens, want fewer than the burst", tokens)
+	}
+	sm.releaseQuota("k", again)
+
+	// 令牌桶回满（5 / 50 每秒 = 100ms）后删除
+	waitFor(t, "idle quota dropped", func() bool {
+		sm.quotaMu.Lock()
+		defer sm.quotaMu.Unlock()
+		_, ok := sm.quotas["k"]
+		return !ok
+	})
+}
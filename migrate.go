@@ -0,0 +1,164 @@
+package rdialer
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/midy177/webtransport-go"
+	"github.com/rs/zerolog/log"
+)
+
+// 保活应答字节：keepaliveEcho 为普通应答，keepaliveControl 表示其后紧跟一个控制消息帧
+const (
+	keepaliveEcho    byte = 0
+	keepaliveControl byte = 1
+)
+
+// migrateVersion 是支持迁移控制消息的最低协议版本
+const migrateVersion = 2
+
+// Migrate 通知 clientKey 的全部会话重连到 target（如 https://other:8443/connect），
+// 客户端在新会话建立后才停止使用旧会话，旧会话上的隧道连接结束后关闭。
+// 迁移消息经控制通道发送，旧版本客户端随下一次保活应答送达，返回通知到的会话数，不支持迁移的客户端会被跳过。
+func (s *Server) Migrate(clientKey, target string) (int, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return 0, err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return 0, fmt.Errorf("invalid migration target %q", target)
+	}
+	var n int
+	for _, ss := range s.sessions.sessionsOf(clientKey) {
+		if cc := ss.control.Load(); cc != nil {
+			if err := cc.send(MigrateNotice{URL: u.String()}); err == nil {
+				n++
+			}
+			continue
+		}
+		if ss.protocolVersion < migrateVersion {
+			continue
+		}
+		// 只保留最近一次迁移目标
+		select {
+		case <-ss.migrate:
+		default:
+		}
+		select {
+		case ss.migrate <- u.String():
+			n++
+		default:
+		}
+	}
+	return n, nil
+}
+
+// legacyKeepalive 是服务端旧版本保活流的处理函数，应答客户端的保活字节，有待发送的迁移目标时随应答发送迁移消息
+func (ss *serverSession) legacyKeepalive(stream webtransport.Stream, keepalive keepaliveConfig) {
+	remoteAddr := ss.session.RemoteAddr()
+	localAddr := ss.session.LocalAddr()
+	streamID := stream.StreamID()
+	// 旧版本客户端的保活间隔固定，不能短于该间隔判定失效
+	timeout := keepalive.timeout(max(keepalive.interval, legacyKeepaliveInterval))
+	keepMsg := make([]byte, 1)
+	for {
+		_ = stream.SetReadDeadline(time.Now().Add(timeout))
+		_, err := stream.Read(keepMsg)
+		if isTimeout(err) {
+			ss.evict()
+			return
+		}
+		if err != nil {
+			log.Error().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Err(err).Msg("read keepalive")
+			return
+		}
+		log.Debug().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).
+			Int64("StreamID", int64(streamID)).Str("Role", "server").Msg("read keepalive")
+		select {
+		case target := <-ss.migrate:
+			_, err = stream.Write([]byte{keepaliveControl})
+			if err == nil {
+				_, err = NewEncodeBuffer(Migrate, []byte(target)).WriteTo(stream)
+			}
+			log.Info().Str("ClientKey", ss.clientKey).Str("RemoteAddr", remoteAddr.String()).
+				Str("Target", target).Msg("migration requested")
+		default:
+			_, err = stream.Write([]byte{keepaliveEcho})
+		}
+		if err != nil {
+			log.Error().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Err(err).Msg("write keepalive")
+			return
+		}
+		log.Debug().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).
+			Int64("StreamID", int64(streamID)).Str("Role", "server").Msg("send keepalive")
+	}
+}
+
+// migratedError 表示会话已按服务端要求迁移到 next
+type migratedError struct {
+	target string
+	next   *clientSession
+}
+
+func (e *migratedError) Error() string {
+	return "session migrated to " + e.target
+}
+
+// migrate 与迁移目标建立新会话，建立成功后新会话进入会话列表
+func (c *Client) migrate(ctx context.Context, cs *clientSession, target string) (*clientSession, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	ep := endpoint{url: u, dialAddr: u.Host}
+	if u.Port() == "" {
+		ep.dialAddr = u.Host + ":443"
+	}
+	if !c.reserve(ep) {
+		return nil, fmt.Errorf("too many sessions to %s", ep.dialAddr)
+	}
+	header := cs.header.Clone()
+	c.setLabelsHeader(header)
+	start := time.Now()
+	session, version, err := c.dial(ctx, ep, header)
+	c.recordResult(ep, time.Since(start), err)
+	if err != nil {
+		c.release(ep, nil)
+		return nil, err
+	}
+	next := c.newClientSession(ep, session, version, header)
+	c.release(ep, next)
+	return next, nil
+}
+
+// drain 让会话不再承接新的拨号，会话上的隧道连接全部结束后以 reason 关闭会话
+func (c *Client) drain(cs *clientSession, reason string, stop func() bool) {
+	cs.draining.Store(true)
+	c.draining.Add(1)
+	go func() {
+		defer func() {
+			c.draining.Add(-1)
+			stop()
+		}()
+		ticker := time.NewTicker(shutdownPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cs.session.Context().Done():
+				return
+			case <-ticker.C:
+			}
+			idle := true
+			cs.stats.tunnels.Range(func(_, _ any) bool {
+				idle = false
+				return false
+			})
+			if idle {
+				_ = cs.session.CloseWithError(CodeNormal, reason)
+				return
+			}
+		}
+	}()
+}
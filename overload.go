@@ -0,0 +1,115 @@
+package rdialer
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/midy177/webtransport-go"
+)
+
+// CodeOverloaded 是接收端拒绝超出并发或速率上限的流时使用的流重置错误码
+const CodeOverloaded webtransport.StreamErrorCode = 1
+
+// ErrOverloaded 表示对端因过载拒绝了该隧道连接，在连接首次读写时返回，调用方可以退避或换用其他客户端
+var ErrOverloaded = errors.New("peer overloaded, stream rejected")
+
+// concurrencyLimits 限制同时处理的对端打开的流数，上限不大于 0 表示不限制
+type concurrencyLimits struct {
+	perSession int
+	client     *handlerLimit // 同一 clientKey 的全部会话共享，可为 nil
+	global     *handlerLimit // 进程内全部会话共享，可为 nil
+}
+
+// acquire 依次占用会话、客户端和全局的名额，任一达到上限时归还已占用的名额并返回 false
+func (c concurrencyLimits) acquire(session *handlerLimit) bool {
+	if !session.acquire() {
+		return false
+	}
+	if !c.client.acquire() {
+		session.release()
+		return false
+	}
+	if !c.global.acquire() {
+		c.client.release()
+		session.release()
+		return false
+	}
+	return true
+}
+
+// release 归还 acquire 占用的名额
+func (c concurrencyLimits) release(session *handlerLimit) {
+	c.global.release()
+	c.client.release()
+	session.release()
+}
+
+// WithMaxConcurrentStreams 设置服务端同时处理对端打开的流数的上限，perSession 作用于每个会话，
+// global 作用于服务端的全部会话，超出上限的流立即以 CodeOverloaded 重置，不大于 0 表示不限制。
+// 只有隧道连接占用名额，控制通道和保活等流不受限制
+func WithMaxConcurrentStreams(perSession, global int) ServerOption {
+	return func(s *Server) {
+		s.concurrency = newConcurrencyLimits(perSession, global)
+	}
+}
+
+// WithClientMaxConcurrentStreams 设置客户端同时处理服务端打开的流数的上限，语义同 WithMaxConcurrentStreams
+func WithClientMaxConcurrentStreams(perSession, global int) ClientOption {
+	return func(c *Client) {
+		c.concurrency = newConcurrencyLimits(perSession, global)
+	}
+}
+
+func newConcurrencyLimits(perSession, global int) concurrencyLimits {
+	return concurrencyLimits{perSession: perSession, global: newHandlerLimit(global)}
+}
+
+// handlerLimit 是并发处理流数的计数器，上限可在运行时调整
+type handlerLimit struct {
+	max    atomic.Int64
+	active atomic.Int64
+	idle   func() // 名额全部归还时调用，可为 nil
+}
+
+func newHandlerLimit(limit int) *handlerLimit {
+	l := &handlerLimit{}
+	l.max.Store(int64(limit))
+	return l
+}
+
+// acquire 在未达到上限时占用一个名额，不限制时同样计数，以便运行时设置上限后正确归还
+func (l *handlerLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+	if active, limit := l.active.Add(1), l.max.Load(); limit > 0 && active > limit {
+		l.release()
+		return false
+	}
+	return true
+}
+
+// release 归还 acquire 占用的名额
+func (l *handlerLimit) release() {
+	if l != nil && l.active.Add(-1) == 0 && l.idle != nil {
+		l.idle()
+	}
+}
+
+// rejectStream 以 CodeOverloaded 重置流的两个方向
+func rejectStream(stream webtransport.Stream) {
+	stream.CancelRead(CodeOverloaded)
+	stream.CancelWrite(CodeOverloaded)
+}
+
+// overloadError 将对端以 CodeOverloaded 重置流导致的错误转换为 ErrOverloaded
+func overloadError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var streamErr *webtransport.StreamError
+	if errors.As(err, &streamErr) && streamErr.Remote && streamErr.ErrorCode == CodeOverloaded {
+		return ErrOverloaded
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package rdialer
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/midy177/webtransport-go"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/time/rate"
+)
+
+// resetStream 是接收端的 webtransport.Stream，读取预置的消息并记录重置两个方向使用的错误码
+type resetStream struct {
+	webtransport.Stream
+	in        bytes.Reader
+	readCode  *webtransport.StreamErrorCode
+	writeCode *webtransport.StreamErrorCode
+}
+
+// newConnectStream 返回对端发送了一条 Connect 消息的流
+func newConnectStream() *resetStream {
+	var buf bytes.Buffer
+	_, _ = NewEncodeBuffer(Connect, []byte("tcp/127.0.0.1:1")).WriteTo(&buf)
+	s := &resetStream{}
+	s.in.Reset(buf.Bytes())
+	return s
+}
+
+func (s *resetStream) Read(p []byte) (int, error) { return s.in.Read(p) }
+func (s *resetStream) Close() error               { return nil }
+func (s *resetStream) StreamID() quic.StreamID    { return 0 }
+func (s *resetStream) CancelRead(code webtransport.StreamErrorCode) {
+	s.readCode = &code
+}
+func (s *resetStream) CancelWrite(code webtransport.StreamErrorCode) {
+	s.writeCode = &code
+}
+
+// peerResetStream 是拨号端的 webtransport.Stream，模拟对端以 code 重置后本端的读写
+type peerResetStream struct {
+	webtransport.Stream
+	code webtransport.StreamErrorCode
+}
+
+func (s *peerResetStream) Read([]byte) (int, error) {
+	return 0, &webtransport.StreamError{ErrorCode: s.code, Remote: true}
+}
+
+func (s *peerResetStream) Write([]byte) (int, error) {
+	return 0, &webtransport.StreamError{ErrorCode: s.code, Remote: true}
+}
+
+func TestOverloadedStreamRejected(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	tests := []struct {
+		name        string
+		concurrency concurrencyLimits
+		limiter     *rate.Limiter
+		sameSession bool // 占用名额的流与被拒绝的流属于同一个会话
+		held        int  // 预先占用的名额数
+		accepted    bool // 新流应被接受
+	}{
+		{name: "per-session cap", concurrency: newConcurrencyLimits(1, 0), sameSession: true, held: 1},
+		{name: "per-session cap ignores other sessions", concurrency: newConcurrencyLimits(2, 0), held: 2, accepted: true},
+		{name: "global cap across sessions", concurrency: newConcurrencyLimits(0, 2), held: 2},
+		{name: "rate limited", concurrency: newConcurrencyLimits(0, 0), limiter: rate.NewLimiter(0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := tt.limiter
+			if limiter == nil {
+				limiter = rate.NewLimiter(rate.Inf, 0)
+			}
+			stats := &streamStats{}
+			admit := newStreamAdmitter("client", addr, stats, limiter, tt.concurrency)
+			other := admit
+			if !tt.sameSession {
+				other = newStreamAdmitter("client", addr, &streamStats{}, limiter, tt.concurrency)
+			}
+			var releases []func()
+			for range tt.held {
+				release, ok := other(&resetStream{})
+				if !ok {
+					t.Fatal("held stream rejected")
+				}
+				releases = append(releases, release)
+			}
+
+			stream := newConnectStream()
+			if tt.accepted {
+				release, ok := admit(stream)
+				if !ok {
+					t.Fatal("stream on another session rejected")
+				}
+				release()
+				return
+			}
+			handleStream(stream, addr, addr, stats, TunnelTimeouts{}, nil, admit)
+			if stream.readCode == nil || *stream.readCode != CodeOverloaded ||
+				stream.writeCode == nil || *stream.writeCode != CodeOverloaded {
+				t.Fatalf("stream reset with read %v write %v, want %d on both", stream.readCode, stream.writeCode, CodeOverloaded)
+			}
+			if stats.rejected != 1 {
+				t.Fatalf("rejected = %d, want 1", stats.rejected)
+			}
+
+			// 拨号端首次读或写即得到 ErrOverloaded
+			for _, op := range []string{"read", "write", "early read", "early write"} {
+				conn, err := newConnection(&peerResetStream{code: *stream.writeCode}, "tcp", "127.0.0.1:1", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.HasPrefix(op, "early") {
+					conn.early = &earlyData{header: []byte("HDR"), awaitResult: true}
+				}
+				if strings.HasSuffix(op, "read") {
+					_, err = conn.Read(make([]byte, 1))
+				} else {
+					_, err = conn.Write([]byte("x"))
+				}
+				if !errors.Is(err, ErrOverloaded) {
+					t.Fatalf("first %s: err = %v, want ErrOverloaded", op, err)
+				}
+			}
+
+			// 名额归还后同一会话的新流被接受
+			for _, release := range releases {
+				release()
+			}
+			if tt.limiter == nil {
+				release, ok := admit(newConnectStream())
+				if !ok {
+					t.Fatal("stream rejected after quota released")
+				}
+				release()
+			}
+		})
+	}
+}
+
+func TestOverloadErrorIgnoresOtherResets(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "nil", err: nil, want: nil},
+		{name: "local overloaded reset", err: &webtransport.StreamError{ErrorCode: CodeOverloaded}},
+		{name: "remote other code", err: &webtransport.StreamError{ErrorCode: CodeOverloaded + 1, Remote: true}},
+		{name: "remote overloaded", err: &webtransport.StreamError{ErrorCode: CodeOverloaded, Remote: true}, want: ErrOverloaded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.want
+			if want == nil {
+				want = tt.err
+			}
+			if got := overloadError(tt.err); got != want {
+				t.Fatalf("overloadError(%v) = %v, want %v", tt.err, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package rdialer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Record 是 clientKey 的归属记录，表示该客户端在 NodeID 节点上持有会话
+type Record struct {
+	ClientKey string            `json:"clientKey"`
+	NodeID    string            `json:"nodeId"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	LastSeen  time.Time         `json:"lastSeen"`
+}
+
+// Registry 存储集群中 clientKey 到节点的归属记录。
+// 记录在 LastSeen 之后超过 TTL 未刷新即视为过期，用于清理崩溃节点遗留的记录，
+// 实现可以将记录保存在外部存储中供多个节点共享。
+type Registry interface {
+	// Put 写入或刷新一条记录，LastSeen 为零值时使用当前时间
+	Put(ctx context.Context, record Record) error
+	// Delete 删除 clientKey 在 nodeID 上的记录
+	Delete(ctx context.Context, clientKey, nodeID string) error
+	// Lookup 返回 clientKey 未过期的全部记录
+	Lookup(ctx context.Context, clientKey string) ([]Record, error)
+	// List 返回全部未过期的记录
+	List(ctx context.Context) ([]Record, error)
+}
+
+type recordKey struct {
+	clientKey string
+	nodeID    string
+}
+
+// memoryRegistry 是进程内的 Registry 实现
+type memoryRegistry struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	records map[recordKey]Record
+}
+
+// NewMemoryRegistry 创建进程内的 Registry，ttl 为 0 时记录不会过期
+func NewMemoryRegistry(ttl time.Duration) Registry {
+	return &memoryRegistry{
+		ttl:     ttl,
+		records: make(map[recordKey]Record),
+	}
+}
+
+func (r *memoryRegistry) Put(_ context.Context, record Record) error {
+	if record.LastSeen.IsZero() {
+		record.LastSeen = time.Now()
+	}
+	record.Labels = maps.Clone(record.Labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records[recordKey{record.ClientKey, record.NodeID}] = record
+	return nil
+}
+
+func (r *memoryRegistry) Delete(_ context.Context, clientKey, nodeID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.records, recordKey{clientKey, nodeID})
+	return nil
+}
+
+func (r *memoryRegistry) Lookup(_ context.Context, clientKey string) ([]Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire()
+	var records []Record
+	for key, record := range r.records {
+		if key.clientKey == clientKey {
+			records = append(records, record)
+		}
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+func (r *memoryRegistry) List(_ context.Context) ([]Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire()
+	records := make([]Record, 0, len(r.records))
+	for _, record := range r.records {
+		records = append(records, record)
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+// expire 删除过期记录，调用方需持有 r.mu
+func (r *memoryRegistry) expire() {
+	if r.ttl <= 0 {
+		return
+	}
+	for key, record := range r.records {
+		if time.Since(record.LastSeen) > r.ttl {
+			delete(r.records, key)
+		}
+	}
+}
+
+// fileRegistry 是将记录保存在本地 JSON 文件中的 Registry 实现，
+// 同一主机上的多个进程可以共享同一个文件（例如测试中的多个节点）。
+// 文件通过临时文件加重命名整体替换，写入期间持有 path+".lock" 上的排他 flock，
+// 多个进程的读改写不会互相覆盖。
+type fileRegistry struct {
+	mu   sync.Mutex
+	path string
+	ttl  time.Duration
+}
+
+// NewFileRegistry 创建保存在 path 文件中的 Registry，ttl 为 0 时记录不会过期
+func NewFileRegistry(path string, ttl time.Duration) Registry {
+	return &fileRegistry{path: path, ttl: ttl}
+}
+
+func (r *fileRegistry) Put(_ context.Context, record Record) error {
+	if record.LastSeen.IsZero() {
+		record.LastSeen = time.Now()
+	}
+	return r.update(func(records map[recordKey]Record) {
+		records[recordKey{record.ClientKey, record.NodeID}] = record
+	})
+}
+
+func (r *fileRegistry) Delete(_ context.Context, clientKey, nodeID string) error {
+	return r.update(func(records map[recordKey]Record) {
+		delete(records, recordKey{clientKey, nodeID})
+	})
+}
+
+func (r *fileRegistry) Lookup(ctx context.Context, clientKey string) ([]Record, error) {
+	all, err := r.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	for _, record := range all {
+		if record.ClientKey == clientKey {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (r *fileRegistry) List(_ context.Context) ([]Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	records, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Record, 0, len(records))
+	for _, record := range records {
+		list = append(list, record)
+	}
+	sortRecords(list)
+	return list, nil
+}
+
+// update 读取文件、修改记录并写回，同时清理过期记录
+func (r *fileRegistry) update(fn func(records map[recordKey]Record)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	records, err := r.load()
+	if err != nil {
+		return err
+	}
+	fn(records)
+
+	list := make([]Record, 0, len(records))
+	for _, record := range records {
+		list = append(list, record)
+	}
+	sortRecords(list)
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// lock 获取锁文件上的排他 flock，跨进程串行化 update，调用方需持有 r.mu。
+// 锁加在单独的文件上，因为 r.path 会被重命名替换
+func (r *fileRegistry) lock() (func(), error) {
+	f, err := os.OpenFile(r.path+".lock", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if !errors.Is(err, syscall.EINTR) {
+			break
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
+
+// load 读取未过期的记录，文件不存在时返回空集合，调用方需持有 r.mu
+func (r *fileRegistry) load() (map[recordKey]Record, error) {
+	records := make(map[recordKey]Record)
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Record
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+	}
+	for _, record := range list {
+		if r.ttl > 0 && time.Since(record.LastSeen) > r.ttl {
+			continue
+		}
+		records[recordKey{record.ClientKey, record.NodeID}] = record
+	}
+	return records, nil
+}
+
+func sortRecords(records []Record) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].ClientKey != records[j].ClientKey {
+			return records[i].ClientKey < records[j].ClientKey
+		}
+		return records[i].NodeID < records[j].NodeID
+	})
+}
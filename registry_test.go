@@ -0,0 +1,157 @@
+package rdialer
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	registries := []struct {
+		name string
+		new  func(t *testing.T, ttl time.Duration) Registry
+	}{
+		{name: "memory", new: func(_ *testing.T, ttl time.Duration) Registry { return NewMemoryRegistry(ttl) }},
+		{name: "file", new: func(t *testing.T, ttl time.Duration) Registry {
+			return NewFileRegistry(filepath.Join(t.TempDir(), "registry.json"), ttl)
+		}},
+	}
+	tests := []struct {
+		name       string
+		ttl        time.Duration
+		ages       map[string]time.Duration // 以 "clientKey/nodeID" 为键的记录距离上次刷新的时长
+		delete     string                   // 写入后删除的记录
+		lookup     string
+		wantList   []string
+		wantLookup []string
+	}{
+		{
+			name:       "no ttl keeps old records",
+			ages:       map[string]time.Duration{"a/n1": time.Hour, "a/n2": 0, "b/n1": 0},
+			lookup:     "a",
+			wantList:   []string{"a/n1", "a/n2", "b/n1"},
+			wantLookup: []string{"a/n1", "a/n2"},
+		},
+		{
+			name:       "ttl expires stale records",
+			ttl:        time.Minute,
+			ages:       map[string]time.Duration{"a/n1": time.Hour, "a/n2": time.Second, "b/n1": 2 * time.Minute},
+			lookup:     "a",
+			wantList:   []string{"a/n2"},
+			wantLookup: []string{"a/n2"},
+		},
+		{
+			name:       "delete",
+			ttl:        time.Minute,
+			ages:       map[string]time.Duration{"a/n1": 0, "a/n2": 0},
+			delete:     "a/n1",
+			lookup:     "a",
+			wantList:   []string{"a/n2"},
+			wantLookup: []string{"a/n2"},
+		},
+		{
+			name:     "lookup unknown client",
+			ages:     map[string]time.Duration{"a/n1": 0},
+			lookup:   "b",
+			wantList: []string{"a/n1"},
+		},
+	}
+	ctx := context.Background()
+	for _, reg := range registries {
+		for _, tt := range tests {
+			t.Run(reg.name+"/"+tt.name, func(t *testing.T) {
+				r := reg.new(t, tt.ttl)
+				now := time.Now()
+				for key, age := range tt.ages {
+					clientKey, nodeID := splitRecordKey(key)
+					if err := r.Put(ctx, Record{ClientKey: clientKey, NodeID: nodeID, LastSeen: now.Add(-age)}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if tt.delete != "" {
+					clientKey, nodeID := splitRecordKey(tt.delete)
+					if err := r.Delete(ctx, clientKey, nodeID); err != nil {
+						t.Fatal(err)
+					}
+				}
+				list, err := r.List(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := recordKeys(list); !slices.Equal(got, tt.wantList) {
+					t.Fatalf("List = %v, want %v", got, tt.wantList)
+				}
+				lookup, err := r.Lookup(ctx, tt.lookup)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := recordKeys(lookup); !slices.Equal(got, tt.wantLookup) {
+					t.Fatalf("Lookup(%q) = %v, want %v", tt.lookup, got, tt.wantLookup)
+				}
+			})
+		}
+	}
+}
+
+func TestRegistryPutDefaultsLastSeen(t *testing.T) {
+	r := NewMemoryRegistry(time.Minute)
+	if err := r.Put(context.Background(), Record{ClientKey: "a", NodeID: "n1"}); err != nil {
+		t.Fatal(err)
+	}
+	records, _ := r.Lookup(context.Background(), "a")
+	if len(records) != 1 || time.Since(records[0].LastSeen) > time.Minute {
+		t.Fatalf("records = %v, want one fresh record", records)
+	}
+}
+
+// TestFileRegistryConcurrentWriters 模拟多个进程共享同一个文件：
+// 每个节点使用独立的 fileRegistry，并发写入的记录都不应丢失
+func TestFileRegistryConcurrentWriters(t *testing.T) {
+	const nodes, puts = 4, 20
+	path := filepath.Join(t.TempDir(), "registry.json")
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, nodes*puts)
+	for n := range nodes {
+		r := NewFileRegistry(path, 0)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range puts {
+				errs <- r.Put(ctx, Record{ClientKey: fmt.Sprintf("c%d", i), NodeID: fmt.Sprintf("n%d", n)})
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := NewFileRegistry(path, 0).List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != nodes*puts {
+		t.Fatalf("got %d records, want %d", len(list), nodes*puts)
+	}
+}
+
+func splitRecordKey(key string) (clientKey, nodeID string) {
+	clientKey, nodeID, _ = strings.Cut(key, "/")
+	return clientKey, nodeID
+}
+
+func recordKeys(records []Record) []string {
+	var keys []string
+	for _, record := range records {
+		keys = append(keys, record.ClientKey+"/"+record.NodeID)
+	}
+	return keys
+}
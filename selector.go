@@ -0,0 +1,104 @@
+package rdialer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Selector 是标签选择器，由逗号分隔的条件组成，所有条件都满足时匹配：
+//
+//	key=value   标签等于 value
+//	key!=value  标签不存在或不等于 value
+//	key         标签存在
+type Selector []selectorTerm
+
+type selectorTerm struct {
+	key   string
+	value string
+	op    string // "=", "!=" 或 "exists"
+}
+
+// ParseSelector 解析形如 "region=eu,env=prod" 的标签选择器
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var term selectorTerm
+		if k, v, ok := strings.Cut(part, "!="); ok {
+			term = selectorTerm{key: strings.TrimSpace(k), value: strings.TrimSpace(v), op: "!="}
+		} else if k, v, ok := strings.Cut(part, "="); ok {
+			term = selectorTerm{key: strings.TrimSpace(k), value: strings.TrimSpace(v), op: "="}
+		} else {
+			term = selectorTerm{key: part, op: "exists"}
+		}
+		if term.key == "" {
+			return nil, fmt.Errorf("invalid selector term %q", part)
+		}
+		sel = append(sel, term)
+	}
+	return sel, nil
+}
+
+// Matches 判断标签是否满足选择器，空选择器匹配所有标签
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, term := range sel {
+		value, ok := labels[term.key]
+		switch term.op {
+		case "=":
+			if !ok || value != term.value {
+				return false
+			}
+		case "!=":
+			if ok && value == term.value {
+				return false
+			}
+		default:
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (sel Selector) String() string {
+	parts := make([]string, len(sel))
+	for i, term := range sel {
+		if term.op == "exists" {
+			parts[i] = term.key
+		} else {
+			parts[i] = term.key + term.op + term.value
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseLabels 解析握手请求头中 "k=v,k=v" 格式的标签
+func parseLabels(s string) map[string]string {
+	labels := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		if k = strings.TrimSpace(k); k != "" {
+			labels[k] = strings.TrimSpace(v)
+		}
+	}
+	return labels
+}
+
+// formatLabels 将标签编码为 "k=v,k=v"，按键排序以保证输出稳定
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + labels[k]
+	}
+	return strings.Join(parts, ",")
+}
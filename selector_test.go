@@ -0,0 +1,86 @@
+package rdialer
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string // String() 的结果
+		wantErr bool
+	}{
+		{in: "", want: ""},
+		{in: "region=eu", want: "region=eu"},
+		{in: " region = eu , env!=prod ,gpu", want: "region=eu,env!=prod,gpu"},
+		{in: "a=,b", want: "a=,b"},
+		{in: "region=eu,,", want: "region=eu"},
+		{in: "=eu", wantErr: true},
+		{in: "!=eu", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			sel, err := ParseSelector(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSelector(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if err == nil && sel.String() != tt.want {
+				t.Fatalf("ParseSelector(%q) = %q, want %q", tt.in, sel.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"region": "eu", "env": "prod", "empty": ""}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{selector: "", want: true},
+		{selector: "region=eu", want: true},
+		{selector: "region=us", want: false},
+		{selector: "region=eu,env=prod", want: true},
+		{selector: "region=eu,env=dev", want: false},
+		{selector: "env!=dev", want: true},
+		{selector: "env!=prod", want: false},
+		{selector: "zone!=a", want: true},
+		{selector: "region", want: true},
+		{selector: "zone", want: false},
+		{selector: "empty", want: true},
+		{selector: "empty=", want: true},
+		{selector: "zone=", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			sel, err := ParseSelector(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sel.Matches(labels); got != tt.want {
+				t.Fatalf("%q.Matches(%v) = %v, want %v", tt.selector, labels, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+	}{
+		{in: "", want: map[string]string{}},
+		{in: "region=eu, env = prod", want: map[string]string{"region": "eu", "env": "prod"}},
+		{in: "gpu,=x,a=1", want: map[string]string{"gpu": "", "a": "1"}},
+	}
+	for _, tt := range tests {
+		got := parseLabels(tt.in)
+		if !maps.Equal(got, tt.want) {
+			t.Errorf("parseLabels(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		if tt.in != "" && !maps.Equal(parseLabels(formatLabels(got)), got) {
+			t.Errorf("formatLabels(%v) does not round-trip", got)
+		}
+	}
+}
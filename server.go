@@ -11,7 +11,9 @@ import (
 	"math/big"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/midy177/webtransport-go"
@@ -24,6 +26,30 @@ var (
 	errFailedAuth = errors.New("failed authentication")
 )
 
+// ProtocolVersion 是握手中双方声明的 rdialer 协议版本：
+//   - 2：迁移控制消息
+//   - 3：控制通道
+//   - 4：数据报保活探测
+//   - 5：拨号携带隧道超时
+//   - 6：乐观拨号（early data）
+const ProtocolVersion = 6
+
+// 客户端握手请求头
+const (
+	// instanceHeader 携带客户端实例及会话槽位标识，用于识别同一客户端的重连
+	instanceHeader = "rdialer-instance"
+	// weightHeader 携带客户端声明的权重，供 WeightedBalancer 使用
+	weightHeader = "rdialer-weight"
+	// versionHeader 携带客户端的协议版本
+	versionHeader = "rdialer-version"
+	// labelsHeader 携带客户端自行声明的标签，格式为 "k=v,k=v"
+	labelsHeader = "rdialer-labels"
+	// groupHeader 携带客户端所属的组
+	groupHeader = "rdialer-group"
+	// priorityHeader 携带客户端在组内的优先级
+	priorityHeader = "rdialer-priority"
+)
+
 type Authorizer func(req *http.Request) (clientKey string, authed bool, err error)
 
 func DefaultAuthorizer(req *http.Request) (clientKey string, authed bool, err error) {
@@ -31,6 +57,43 @@ func DefaultAuthorizer(req *http.Request) (clientKey string, authed bool, err er
 	return id, id != "", nil
 }
 
+// Identity 是认证得到的客户端身份
+type Identity struct {
+	ClientKey string
+	// Labels 是认证方赋予的标签（如 region、env、customer、hostname），
+	// 与客户端自行声明的标签合并时优先级更高
+	Labels map[string]string
+	// Group 和 Priority 是会话所属的组及组内优先级，只由认证方决定，客户端通过 WithGroup 声明的值不会被直接采用。
+	// 需要采用声明值的认证方可以用 DeclaredGroup 读取并按租户校验后填入
+	Group    string
+	Priority int
+}
+
+// DeclaredGroup 返回客户端通过 WithGroup 声明的组及组内优先级，这些值由客户端控制，未经校验不应直接信任
+func DeclaredGroup(req *http.Request) (group string, priority int) {
+	priority, _ = strconv.Atoi(req.Header.Get(priorityHeader))
+	return req.Header.Get(groupHeader), priority
+}
+
+// IdentityAuthorizer 认证请求并返回带标签的客户端身份
+type IdentityAuthorizer func(req *http.Request) (identity *Identity, authed bool, err error)
+
+// identityAuthorizer 将 Authorizer 适配为 IdentityAuthorizer，会话不属于任何组，需要分组时应使用 IdentityAuthorizer
+func (a Authorizer) identityAuthorizer() IdentityAuthorizer {
+	return func(req *http.Request) (*Identity, bool, error) {
+		clientKey, authed, err := a(req)
+		return &Identity{ClientKey: clientKey}, authed, err
+	}
+}
+
+// defaultIdentityAuthorizer 是未设置认证函数时使用的 DefaultAuthorizer，
+// 它本身信任客户端声明的 clientKey，因此同样采用客户端声明的组和优先级
+func defaultIdentityAuthorizer(req *http.Request) (*Identity, bool, error) {
+	clientKey, authed, err := DefaultAuthorizer(req)
+	group, priority := DeclaredGroup(req)
+	return &Identity{ClientKey: clientKey, Group: group, Priority: priority}, authed, err
+}
+
 type ErrorWriter func(rw http.ResponseWriter, req *http.Request, code int, err error)
 
 func DefaultErrorWriter(rw http.ResponseWriter, req *http.Request, code int, err error) {
@@ -40,15 +103,23 @@ func DefaultErrorWriter(rw http.ResponseWriter, req *http.Request, code int, err
 
 // Server 表示一个 WebTransport 服务器
 type Server struct {
-	addr           string
-	authorizer     Authorizer
-	errorWriter    ErrorWriter
-	sessions       *sessionManager
-	wtServer       *webtransport.Server // WebTransport 服务器
-	mu             *sync.Mutex
-	certificate    string
-	certificateKey string
-	closed         bool
+	addr            string
+	authorizer      IdentityAuthorizer
+	keepalive       keepaliveConfig
+	errorWriter     ErrorWriter
+	sessions        *sessionManager
+	wtServer        *webtransport.Server // WebTransport 服务器
+	mu              *sync.Mutex
+	certificate     string
+	certificateKey  string
+	closed          bool
+	draining        atomic.Bool   // Shutdown 期间拒绝新会话
+	drained         chan struct{} // 首次调用的 Shutdown 返回时关闭
+	cluster         *cluster      // 未启用集群时为 nil
+	controlHandlers []func(clientKey string, msg ControlMessage)
+	concurrency     concurrencyLimits
+	bufferBudget    BufferBudget
+	reauthTimeout   time.Duration // 等待 ReAuthResponse 的最长时间，不大于 0 表示不限制
 }
 
 // ServerOption 定义服务器配置选项
@@ -69,6 +140,13 @@ func WithQUICConfig(config *quic.Config) ServerOption {
 }
 
 func WithAuthorizer(authorizer Authorizer) ServerOption {
+	return func(s *Server) {
+		s.authorizer = authorizer.identityAuthorizer()
+	}
+}
+
+// WithIdentityAuthorizer 设置返回客户端身份和标签的认证函数，覆盖 WithAuthorizer
+func WithIdentityAuthorizer(authorizer IdentityAuthorizer) ServerOption {
 	return func(s *Server) {
 		s.authorizer = authorizer
 	}
@@ -86,6 +164,27 @@ func WithHandleFuncPattern(pattern string) ServerOption {
 	}
 }
 
+// WithSessionPolicy 设置同一 clientKey 重复连接时的会话准入策略
+func WithSessionPolicy(policy SessionPolicy) ServerOption {
+	return func(s *Server) {
+		s.sessions.policy = policy
+	}
+}
+
+// WithBalancer 设置在同一 clientKey 的多个会话间选择会话的负载均衡策略，默认随机选择
+func WithBalancer(balancer Balancer) ServerOption {
+	return func(s *Server) {
+		s.sessions.balancer = balancer
+	}
+}
+
+// WithClientBalancer 为指定 clientKey 覆盖负载均衡策略
+func WithClientBalancer(clientKey string, balancer Balancer) ServerOption {
+	return func(s *Server) {
+		s.sessions.setBalancer(clientKey, balancer)
+	}
+}
+
 func WithCertificate(certFile, keyFile string) ServerOption {
 	return func(s *Server) {
 		s.certificate = certFile
@@ -106,7 +205,8 @@ func NewServer(addr string, options ...ServerOption) *Server {
 				Addr: addr,
 			},
 		},
-		mu: &sync.Mutex{},
+		mu:      &sync.Mutex{},
+		drained: make(chan struct{}),
 	}
 
 	for _, opt := range options {
@@ -114,12 +214,19 @@ func NewServer(addr string, options ...ServerOption) *Server {
 	}
 
 	if s.authorizer == nil {
-		s.authorizer = DefaultAuthorizer
+		s.authorizer = defaultIdentityAuthorizer
 	}
 
 	if s.errorWriter == nil {
 		s.errorWriter = DefaultErrorWriter
 	}
+	s.keepalive = s.keepalive.withDefaults()
+	switch {
+	case s.reauthTimeout == 0:
+		s.reauthTimeout = DefaultReauthTimeout
+	case s.reauthTimeout < 0:
+		s.reauthTimeout = 0
+	}
 
 	if s.certificate == "" || s.certificateKey == "" {
 		s.certificate = "cert.pem"
@@ -139,6 +246,7 @@ func NewServer(addr string, options ...ServerOption) *Server {
 			MaxIncomingStreams: 100000,
 		}
 	}
+	s.wtServer.H3.QUICConfig = limitReceiveWindows(s.wtServer.H3.QUICConfig, s.bufferBudget)
 
 	return s
 }
@@ -155,10 +263,13 @@ func (s *Server) Start() error {
 		log.Info().Msg("Generated new certificate files")
 	}
 	log.Info().Msgf("Listening on %s", s.addr)
+	if s.cluster != nil {
+		s.cluster.start()
+	}
 	return s.wtServer.ListenAndServeTLS(s.certificate, s.certificateKey)
 }
 
-// Close 关闭服务器
+// Close 立即关闭服务器和全部会话，进行中的隧道连接随之中断，需要等待连接结束时使用 Shutdown
 func (s *Server) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -171,6 +282,9 @@ func (s *Server) Close() error {
 
 	// 关闭所有会话
 	s.sessions.removeAll()
+	if s.cluster != nil {
+		s.cluster.close()
+	}
 
 	// 关闭服务器
 	if s.wtServer != nil {
@@ -183,31 +297,109 @@ func (s *Server) Close() error {
 // SetHandleFuncPattern 设置 WebTransport 会话处理函数
 func (s *Server) SetHandleFuncPattern(pattern string) {
 	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
-		clientKey, authed, err := s.authorizer(r)
+		if s.cluster != nil && r.Header.Get(peerHeader) != "" {
+			s.cluster.accept(w, r, s)
+			return
+		}
+		identity, authed, err := s.authorizer(r)
 		if err != nil {
 			s.errorWriter(w, r, 400, err)
 			return
 		}
-		if !authed {
+		if !authed || identity == nil {
 			s.errorWriter(w, r, 401, errFailedAuth)
 			return
 		}
+		if s.draining.Load() {
+			s.errorWriter(w, r, http.StatusServiceUnavailable, errServerDraining)
+			return
+		}
+		clientKey := identity.ClientKey
+		if remaining := s.sessions.quarantinedFor(clientKey); remaining > 0 {
+			s.writeQuarantined(w, r, remaining)
+			return
+		}
+		instanceID := r.Header.Get(instanceHeader)
+		if err := s.sessions.admit(clientKey, instanceID); err != nil {
+			s.errorWriter(w, r, http.StatusConflict, err)
+			return
+		}
+		w.Header().Set(versionHeader, strconv.Itoa(ProtocolVersion))
 		session, err := s.wtServer.Upgrade(w, r)
 		if err != nil {
 			log.Err(err).Msg("Upgrade failed")
 			return
 		}
-		s.sessions.add(clientKey, session)
-		defer s.sessions.remove(clientKey, session)
-		handleSession(clientKey, session)
+		weight, err := strconv.Atoi(r.Header.Get(weightHeader))
+		if err != nil || weight <= 0 {
+			weight = 1
+		}
+		version, _ := strconv.Atoi(r.Header.Get(versionHeader))
+		ss := &serverSession{
+			clientKey:       clientKey,
+			instanceID:      instanceID,
+			session:         session,
+			protocolVersion: version,
+			identityLabels:  identity.Labels,
+			group:           identity.Group,
+			priority:        identity.Priority,
+			weight:          weight,
+			migrate:         make(chan string, 1),
+		}
+		ss.stats.shaping = s.sessions.bandwidth
+		ss.stats.budget = newBudgetGroup(s.bufferBudget)
+		// 认证方赋予的标签覆盖客户端自行声明的同名标签
+		ss.setLabels(parseLabels(r.Header.Get(labelsHeader)))
+		if err := s.sessions.add(ss); err != nil {
+			// 并发连接在升级期间抢占了名额
+			log.Warn().Str("ClientKey", clientKey).Err(err).Msg("Session rejected")
+			_ = session.CloseWithError(CodeRejected, err.Error())
+			return
+		}
+		defer s.sessions.remove(ss)
+		concurrency := s.concurrency
+		concurrency.client = ss.quota.active
+		handleSession(clientKey, session, &ss.stats, ss.quota.streams, concurrency, s.sessions.timeouts, map[MessageType]messageHandler{
+			KeepAlive: func(stream webtransport.Stream, _ []byte) {
+				ss.legacyKeepalive(stream, s.keepalive)
+			},
+			Control: func(stream webtransport.Stream, _ []byte) {
+				s.serveControl(ss, stream)
+			},
+		})
 		log.Info().Str("ClientKey", clientKey).Msg("Session remove")
 	})
 }
 
+// GetDialer 返回绑定到 clientKey 的拨号器，启用集群时本节点没有该客户端的会话会转发到持有它的节点
 func (s *Server) GetDialer(clientKey string) (Dialer, error) {
+	if s.cluster != nil {
+		return s.cluster.getDialer(clientKey)
+	}
 	return s.sessions.getDialer(clientKey)
 }
 
+// GetDialerBySelector 返回在标签匹配 selector 的健康会话中选择会话的拨号器，
+// 适用于多个可互换客户端的场景，每次拨号都重新选择
+func (s *Server) GetDialerBySelector(selector string) (Dialer, error) {
+	sel, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return s.sessions.getSelectorDialer(sel)
+}
+
+// GetGroupDialer 返回绑定到客户端组的拨号器，每次拨号都路由到优先级最高的健康成员，
+// 主成员断开后自动切换到备用成员。通过 WithRoutingKey 设置路由键可使相同路由键固定命中同一成员
+func (s *Server) GetGroupDialer(group string) (Dialer, error) {
+	return s.sessions.getGroupDialer(group)
+}
+
+// SetClientBalancer 在运行时覆盖指定 clientKey 的负载均衡策略，balancer 为 nil 时恢复默认策略
+func (s *Server) SetClientBalancer(clientKey string, balancer Balancer) {
+	s.sessions.setBalancer(clientKey, balancer)
+}
+
 func generateCertificate(cert, key string) error {
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -0,0 +1,71 @@
+package rdialer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthorizerGroup(t *testing.T) {
+	trusted := func(req *http.Request) (*Identity, bool, error) {
+		return &Identity{ClientKey: "k", Group: "tenant-a", Priority: 1}, true, nil
+	}
+	tests := []struct {
+		name         string
+		authorizer   IdentityAuthorizer
+		wantGroup    string
+		wantPriority int
+	}{
+		{name: "default trusts declared", authorizer: defaultIdentityAuthorizer, wantGroup: "tenant-b", wantPriority: 1 << 30},
+		{name: "authorizer ignores declared", authorizer: Authorizer(DefaultAuthorizer).identityAuthorizer()},
+		{name: "identity overrides declared", authorizer: trusted, wantGroup: "tenant-a", wantPriority: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodConnect, "/", nil)
+			req.Header.Set("tunnel-id", "k")
+			req.Header.Set(groupHeader, "tenant-b")
+			req.Header.Set(priorityHeader, "1073741824")
+			identity, authed, err := tt.authorizer(req)
+			if err != nil || !authed {
+				t.Fatalf("authorizer = %v, %v", authed, err)
+			}
+			if identity.Group != tt.wantGroup || identity.Priority != tt.wantPriority {
+				t.Fatalf("group = %q/%d, want %q/%d", identity.Group, identity.Priority, tt.wantGroup, tt.wantPriority)
+			}
+		})
+	}
+}
+
+func TestShutdownCalledTwice(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	// 模拟进行中的首次 Shutdown
+	s.draining.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("second Shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		t.Fatal("second Shutdown closed the server during the drain")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	close(s.drained)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("second Shutdown = %v after the drain finished", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second Shutdown did not return after the drain finished")
+	}
+}
@@ -5,12 +5,22 @@ import (
 	"github.com/midy177/webtransport-go"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/time/rate"
+	"net"
+	"sync"
 	"sync/atomic"
 )
 
-// 活动流
+// 会话级流统计，活动流包括对端打开的流和本端拨号打开的流
 type streamStats struct {
-	activeStreams int64
+	activeStreams  int64
+	bytesIn        int64         // 从对端读取的字节数
+	bytesOut       int64         // 写入对端的字节数
+	idleClosed     int64         // 因空闲超时关闭的隧道连接数
+	lifetimeClosed int64         // 因达到最长存活时间关闭的隧道连接数
+	rejected       int64         // 因过载被拒绝的对端打开的流数
+	tunnels        sync.Map      // map[*connection]struct{}，活动的隧道连接
+	shaping        shapingConfig // 隧道连接的带宽限制
+	budget         *budgetGroup  // 隧道连接共享的缓冲预算，为 nil 时只限制单个连接
 }
 
 var (
@@ -21,22 +31,29 @@ var (
 	RateBurst = 15000
 )
 
-// handleSession 处理单个 WebTransport 会话
-func handleSession(clientKey string, session *webtransport.Session) {
+// track 登记活动的隧道连接，连接关闭时自动注销
+func (s *streamStats) track(c *connection) {
+	s.tunnels.Store(c, struct{}{})
+}
+
+// newSessionLimiter 创建使用全局默认值的连接级别限流器
+func newSessionLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(RateLimit), RateBurst)
+}
+
+// messageHandler 处理会话上扩展的消息类型，处理函数返回后流被关闭
+type messageHandler func(stream webtransport.Stream, payload []byte)
+
+// handleSession 处理单个 WebTransport 会话，timeouts 是本端配置的隧道超时，
+// handlers 处理扩展的消息类型并优先于内置的 Connect/KeepAlive 处理，可为 nil。
+// 超出速率或并发上限的流立即以 CodeOverloaded 重置
+func handleSession(clientKey string, session *webtransport.Session, stats *streamStats, limiter *rate.Limiter, concurrency concurrencyLimits, timeouts TunnelTimeouts, handlers map[MessageType]messageHandler) {
 	remoteAddr := session.RemoteAddr()
 	localAddr := session.LocalAddr()
-	// 添加连接级别的限流器
-	limiter := rate.NewLimiter(rate.Limit(RateLimit), RateBurst) // 每秒1000个请求，突发100
-	var stats streamStats
 	log.Info().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).
 		Str("clientKey", clientKey).Msg("session accept stream loop")
+	admit := newStreamAdmitter(clientKey, remoteAddr, stats, limiter, concurrency)
 	for {
-		// 限流控制
-		if err := limiter.Wait(context.TODO()); err != nil {
-			log.Warn().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).
-				Str("ClientKey", clientKey).Err(err).Msg("rate limit exceeded")
-			continue
-		}
 		// 接受新的流
 		stream, err := session.AcceptStream(context.TODO())
 		if err != nil {
@@ -49,8 +66,34 @@ func handleSession(clientKey string, session *webtransport.Session) {
 
 		// 处理流
 		go func() {
-			handleStream(stream, remoteAddr, localAddr)
+			handleStream(stream, remoteAddr, localAddr, stats, timeouts, handlers, admit)
 			atomic.AddInt64(&stats.activeStreams, -1)
 		}()
 	}
 }
+
+// newStreamAdmitter 创建会话的 streamAdmitter，对隧道连接做并发控制和限流，超出上限的流立即拒绝而不是排队等待，
+// 先占用并发名额再消耗令牌，避免被拒绝的流白白消耗令牌
+func newStreamAdmitter(clientKey string, remoteAddr net.Addr, stats *streamStats, limiter *rate.Limiter, concurrency concurrencyLimits) streamAdmitter {
+	perSession := newHandlerLimit(concurrency.perSession)
+	return func(stream webtransport.Stream) (func(), bool) {
+		if !concurrency.acquire(perSession) {
+			overloaded(stream, stats, clientKey, remoteAddr)
+			return nil, false
+		}
+		if !limiter.Allow() {
+			concurrency.release(perSession)
+			overloaded(stream, stats, clientKey, remoteAddr)
+			return nil, false
+		}
+		return func() { concurrency.release(perSession) }, true
+	}
+}
+
+// overloaded 拒绝超出上限的流
+func overloaded(stream webtransport.Stream, stats *streamStats, clientKey string, remoteAddr net.Addr) {
+	rejectStream(stream)
+	atomic.AddInt64(&stats.rejected, 1)
+	log.Debug().Str("RemoteAddr", remoteAddr.String()).Str("ClientKey", clientKey).
+		Int64("StreamID", int64(stream.StreamID())).Msg("stream rejected, overloaded")
+}
@@ -0,0 +1,210 @@
+package rdialer
+
+import (
+	"maps"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo 是单个客户端会话的快照
+type SessionInfo struct {
+	ID              int64             `json:"id"`
+	ClientKey       string            `json:"clientKey"`
+	RemoteAddr      string            `json:"remoteAddr"`
+	ConnectedAt     time.Time         `json:"connectedAt"`
+	ProtocolVersion int               `json:"protocolVersion"`
+	QUICVersion     string            `json:"quicVersion"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	ActiveStreams   int64             `json:"activeStreams"`
+	BytesIn         int64             `json:"bytesIn"`
+	BytesOut        int64             `json:"bytesOut"`
+	RTT             time.Duration     `json:"rtt"`             // 最近一次心跳测得的往返时延，未测量时为 0
+	Jitter          time.Duration     `json:"jitter"`          // 数据报探测测得的抖动，未使用数据报探测时为 0
+	LossRate        float64           `json:"lossRate"`        // 数据报探测的丢包率
+	IdleClosed      int64             `json:"idleClosed"`      // 因空闲超时关闭的隧道连接数
+	LifetimeClosed  int64             `json:"lifetimeClosed"`  // 因达到最长存活时间关闭的隧道连接数
+	RejectedStreams int64             `json:"rejectedStreams"` // 因过载被拒绝的客户端打开的流数
+	BufferedBytes   int64             `json:"bufferedBytes"`   // 全部隧道连接已读取尚未写出的字节数
+}
+
+// ClientInfo 是一个 clientKey 下全部会话的汇总快照
+type ClientInfo struct {
+	ClientKey     string    `json:"clientKey"`
+	Sessions      int       `json:"sessions"`
+	ConnectedAt   time.Time `json:"connectedAt"` // 最早建立的会话的连接时间
+	ActiveStreams int64     `json:"activeStreams"`
+	BytesIn       int64     `json:"bytesIn"`
+	BytesOut      int64     `json:"bytesOut"`
+}
+
+// ConnectionInfo 是一个活动隧道连接的快照
+type ConnectionInfo struct {
+	SessionID     int64     `json:"sessionId"`
+	ClientKey     string    `json:"clientKey"`
+	StreamID      int64     `json:"streamId"`
+	Network       string    `json:"network"`
+	Address       string    `json:"address"`
+	Accepted      bool      `json:"accepted"` // true 表示由客户端发起、服务端拨号目标地址
+	StartedAt     time.Time `json:"startedAt"`
+	BytesIn       int64     `json:"bytesIn"`
+	BytesOut      int64     `json:"bytesOut"`
+	BufferedBytes int64     `json:"bufferedBytes"` // 两个方向已读取尚未写出的字节数
+}
+
+func (ss *serverSession) info() SessionInfo {
+	info := SessionInfo{
+		ID:              ss.id,
+		ClientKey:       ss.clientKey,
+		RemoteAddr:      ss.session.RemoteAddr().String(),
+		ConnectedAt:     ss.connectedAt,
+		ProtocolVersion: ss.protocolVersion,
+		QUICVersion:     ss.session.ConnectionState().Version.String(),
+		Labels:          maps.Clone(ss.currentLabels()),
+		ActiveStreams:   atomic.LoadInt64(&ss.stats.activeStreams),
+		BytesIn:         atomic.LoadInt64(&ss.stats.bytesIn),
+		BytesOut:        atomic.LoadInt64(&ss.stats.bytesOut),
+		RTT:             ss.RTT(),
+		IdleClosed:      atomic.LoadInt64(&ss.stats.idleClosed),
+		LifetimeClosed:  atomic.LoadInt64(&ss.stats.lifetimeClosed),
+		RejectedStreams: atomic.LoadInt64(&ss.stats.rejected),
+		BufferedBytes:   ss.stats.budget.buffered(),
+	}
+	info.Jitter, info.LossRate = ss.control.Load().probeStats()
+	return info
+}
+
+// sessionsOf 返回 clientKey 当前会话的副本
+func (sm *sessionManager) sessionsOf(clientKey string) []*serverSession {
+	value, ok := sm.clients.Load(clientKey)
+	if !ok {
+		return nil
+	}
+	cs := value.(*clientSessions)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return append([]*serverSession(nil), cs.sessions...)
+}
+
+// clientKeys 返回当前持有会话的全部 clientKey，按字典序排列
+func (sm *sessionManager) clientKeys() []string {
+	var keys []string
+	sm.clients.Range(func(key, _ any) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// Clients 返回当前已连接客户端的快照，按 clientKey 排序
+func (s *Server) Clients() []ClientInfo {
+	var clients []ClientInfo
+	for _, clientKey := range s.sessions.clientKeys() {
+		sessions := s.sessions.sessionsOf(clientKey)
+		if len(sessions) == 0 {
+			continue
+		}
+		ci := ClientInfo{
+			ClientKey:   clientKey,
+			Sessions:    len(sessions),
+			ConnectedAt: sessions[0].connectedAt,
+		}
+		for _, ss := range sessions {
+			ci.ActiveStreams += atomic.LoadInt64(&ss.stats.activeStreams)
+			ci.BytesIn += atomic.LoadInt64(&ss.stats.bytesIn)
+			ci.BytesOut += atomic.LoadInt64(&ss.stats.bytesOut)
+		}
+		clients = append(clients, ci)
+	}
+	return clients
+}
+
+// Sessions 返回 clientKey 当前会话的快照，按建立顺序排列
+func (s *Server) Sessions(clientKey string) []SessionInfo {
+	sessions := s.sessions.sessionsOf(clientKey)
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, ss := range sessions {
+		infos = append(infos, ss.info())
+	}
+	return infos
+}
+
+// Connections 返回 clientKey 当前活动的隧道连接，clientKey 为空时返回全部客户端的连接
+func (s *Server) Connections(clientKey string) []ConnectionInfo {
+	keys := []string{clientKey}
+	if clientKey == "" {
+		keys = s.sessions.clientKeys()
+	}
+	var conns []ConnectionInfo
+	for _, key := range keys {
+		for _, ss := range s.sessions.sessionsOf(key) {
+			ss.stats.tunnels.Range(func(value, _ any) bool {
+				c := value.(*connection)
+				conns = append(conns, ConnectionInfo{
+					SessionID:     ss.id,
+					ClientKey:     ss.clientKey,
+					StreamID:      int64(c.stream.StreamID()),
+					Network:       c.addr.Network(),
+					Address:       c.addr.String(),
+					Accepted:      c.accepted,
+					StartedAt:     c.startedAt,
+					BytesIn:       atomic.LoadInt64(&c.bytesIn),
+					BytesOut:      atomic.LoadInt64(&c.bytesOut),
+					BufferedBytes: c.inBudget.buffered() + c.outBudget.buffered(),
+				})
+				return true
+			})
+		}
+	}
+	return conns
+}
+
+// ClientSessionInfo 是客户端一侧单个会话的快照
+type ClientSessionInfo struct {
+	Server          string        `json:"server"`
+	DialAddr        string        `json:"dialAddr"`
+	ServerVersion   int           `json:"serverVersion"`
+	Draining        bool          `json:"draining"` // 收到 GOAWAY 或已迁移，不再承接新的拨号
+	ActiveStreams   int64         `json:"activeStreams"`
+	BytesIn         int64         `json:"bytesIn"`
+	BytesOut        int64         `json:"bytesOut"`
+	RTT             time.Duration `json:"rtt"`             // 最近一次保活测得的往返时延，未测量时为 0
+	Jitter          time.Duration `json:"jitter"`          // 数据报探测测得的抖动，未使用数据报探测时为 0
+	LossRate        float64       `json:"lossRate"`        // 数据报探测的丢包率
+	IdleClosed      int64         `json:"idleClosed"`      // 因空闲超时关闭的隧道连接数
+	LifetimeClosed  int64         `json:"lifetimeClosed"`  // 因达到最长存活时间关闭的隧道连接数
+	RejectedStreams int64         `json:"rejectedStreams"` // 因过载被拒绝的服务端打开的流数
+	BufferedBytes   int64         `json:"bufferedBytes"`   // 全部隧道连接已读取尚未写出的字节数
+}
+
+// Sessions 返回客户端当前全部会话的快照，按建立顺序排列
+func (c *Client) Sessions() []ClientSessionInfo {
+	c.mu.Lock()
+	sessions := append([]*clientSession(nil), c.sessions...)
+	c.mu.Unlock()
+
+	infos := make([]ClientSessionInfo, 0, len(sessions))
+	for _, cs := range sessions {
+		info := ClientSessionInfo{
+			Server:          cs.endpoint.url.String(),
+			DialAddr:        cs.endpoint.dialAddr,
+			ServerVersion:   cs.serverVersion,
+			Draining:        cs.draining.Load(),
+			ActiveStreams:   atomic.LoadInt64(&cs.stats.activeStreams),
+			BytesIn:         atomic.LoadInt64(&cs.stats.bytesIn),
+			BytesOut:        atomic.LoadInt64(&cs.stats.bytesOut),
+			RTT:             time.Duration(cs.rtt.Load()),
+			IdleClosed:      atomic.LoadInt64(&cs.stats.idleClosed),
+			LifetimeClosed:  atomic.LoadInt64(&cs.stats.lifetimeClosed),
+			RejectedStreams: atomic.LoadInt64(&cs.stats.rejected),
+			BufferedBytes:   cs.stats.budget.buffered(),
+		}
+		if cc := cs.control.Load(); cc != nil {
+			info.RTT = time.Duration(cc.rtt.Load())
+			info.Jitter, info.LossRate = cc.probeStats()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
@@ -1,11 +1,19 @@
 package rdialer
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/midy177/webtransport-go"
-	"golang.org/x/exp/rand"
+)
+
+var (
+	errTooManySessions = errors.New("too many sessions for client")
+	errDuplicateClient = errors.New("client already connected")
 )
 
 type sessionListener interface {
@@ -13,22 +21,151 @@ type sessionListener interface {
 	sessionRemoved(clientKey string, sessionKey int64)
 }
 
+// DuplicatePolicy 定义同一 clientKey 出现多个会话时的处理策略
+type DuplicatePolicy int
+
+const (
+	// DuplicateAllow 允许多个会话并存，超过 MaxSessions 时拒绝新会话
+	DuplicateAllow DuplicatePolicy = iota
+	// DuplicateReplaceOldest 超过 MaxSessions 时关闭最早建立的会话
+	DuplicateReplaceOldest
+	// DuplicateReject 已存在会话时拒绝新会话
+	DuplicateReject
+)
+
+// SessionPolicy 定义每个 clientKey 的会话准入策略
+type SessionPolicy struct {
+	Duplicate   DuplicatePolicy
+	MaxSessions int // 每个 clientKey 最多同时保持的会话数，0 表示不限制
+}
+
 // 使用 sync.Map 存储客户端会话
 type sessionManager struct {
-	clients sync.Map // map[string]*clientSessions
+	clients   sync.Map // map[string]*clientSessions
+	policy    SessionPolicy
+	balancer  Balancer
+	balancers sync.Map // map[string]Balancer，按 clientKey 覆盖默认负载均衡策略
+	limits    sync.Map // map[string]ClientLimits，按 clientKey 覆盖默认限制
+	quotaMu   sync.Mutex
+	quotas    map[string]*clientQuota // 按 clientKey 共享的配额，客户端没有会话和隧道连接且令牌桶回满后删除
+	listener  sessionListener
+	timeouts  TunnelTimeouts // 服务端配置的隧道超时
+	bandwidth shapingConfig  // 服务端配置的带宽限制，client 字段由各会话按 clientKey 设置
+	// bandwidthPerClient 是未设置 ClientLimits.BytesPerSecond 的客户端的带宽限制
+	bandwidthPerClient int
+	// quarantined 以 clientKey 为键的隔离截止时间
+	quarantined sync.Map // map[string]time.Time
+	nextID      atomic.Int64
 }
 
 // 每个客户端的会话列表
 type clientSessions struct {
 	mu       sync.Mutex
-	sessions []*webtransport.Session
+	sessions []*serverSession // 按建立顺序排列，第一个为最早建立的会话
+}
+
+// serverSession 表示服务端持有的一个客户端会话
+type serverSession struct {
+	id              int64
+	clientKey       string
+	instanceID      string // 客户端实例及会话槽位标识，同一标识的旧会话会被替换
+	session         *webtransport.Session
+	connectedAt     time.Time
+	protocolVersion int
+	labels          atomic.Pointer[map[string]string] // 声明的标签与认证方赋予的标签合并后的结果
+	identityLabels  map[string]string                 // 认证方赋予的标签
+	group           string
+	priority        int // 组内优先级，数值越大越优先
+	weight          int
+	stats           streamStats
+	quota           *clientQuota                   // 与同一 clientKey 的其他会话共享
+	migrate         chan string                    // 待随保活应答发送的迁移目标
+	control         atomic.Pointer[controlChannel] // 未建立控制通道时为 nil
+	reauthTimer     atomic.Pointer[time.Timer]     // 等待 ReAuthResponse 的期限，未要求重新认证时为 nil
+}
+
+func (ss *serverSession) ID() int64 {
+	return ss.id
+}
+
+func (ss *serverSession) ActiveStreams() int64 {
+	return atomic.LoadInt64(&ss.stats.activeStreams)
+}
+
+func (ss *serverSession) RTT() time.Duration {
+	if cc := ss.control.Load(); cc != nil {
+		return time.Duration(cc.rtt.Load())
+	}
+	return 0
+}
+
+func (ss *serverSession) Weight() int {
+	return ss.weight
 }
 
 func newSessionManager() *sessionManager {
-	return &sessionManager{}
+	return &sessionManager{
+		balancer: RandomBalancer(),
+		quotas:   make(map[string]*clientQuota),
+	}
 }
 
+// getDialer 返回绑定到 clientKey 的拨号器，每次拨号都通过负载均衡策略重新选择会话
 func (sm *sessionManager) getDialer(clientKey string) (Dialer, error) {
+	if _, err := sm.pick(clientKey, nil); err != nil {
+		return nil, err
+	}
+	return sm.dialer(func(_ context.Context, exclude map[*webtransport.Session]bool) (*serverSession, error) {
+		return sm.pick(clientKey, exclude)
+	}), nil
+}
+
+// dialer 将服务端会话选择函数包装为每次拨号都重新选择会话的拨号器
+func (sm *sessionManager) dialer(pick func(ctx context.Context, exclude map[*webtransport.Session]bool) (*serverSession, error)) Dialer {
+	return liveDialer(func(ctx context.Context, exclude map[*webtransport.Session]bool) (*webtransport.Session, *streamStats, int, error) {
+		ss, err := pick(ctx, exclude)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		return ss.session, &ss.stats, ss.protocolVersion, nil
+	}, "", sm.timeouts)
+}
+
+// getSelectorDialer 返回在标签匹配 sel 的会话中选择会话的拨号器
+func (sm *sessionManager) getSelectorDialer(sel Selector) (Dialer, error) {
+	if _, err := sm.pickBySelector(sel, nil); err != nil {
+		return nil, err
+	}
+	return sm.dialer(func(_ context.Context, exclude map[*webtransport.Session]bool) (*serverSession, error) {
+		return sm.pickBySelector(sel, exclude)
+	}), nil
+}
+
+// pickBySelector 使用默认负载均衡策略在所有客户端标签匹配 sel 的存活会话中选择一个
+func (sm *sessionManager) pickBySelector(sel Selector, exclude map[*webtransport.Session]bool) (*serverSession, error) {
+	var candidates []Candidate
+	sm.clients.Range(func(_, value any) bool {
+		cs := value.(*clientSessions)
+		cs.mu.Lock()
+		for _, s := range cs.sessions {
+			if exclude[s.session] || s.session.Context().Err() != nil || !sel.Matches(s.currentLabels()) {
+				continue
+			}
+			candidates = append(candidates, s)
+		}
+		cs.mu.Unlock()
+		return true
+	})
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no active sessions match selector %q", sel.String())
+	}
+
+	return pickCandidate(sm.balancer, sel.String(), candidates)
+}
+
+// pick 使用负载均衡策略在 clientKey 的存活会话中选择一个，跳过 exclude 中的会话
+func (sm *sessionManager) pick(clientKey string, exclude map[*webtransport.Session]bool) (*serverSession, error) {
 	value, ok := sm.clients.Load(clientKey)
 	if !ok {
 		return nil, fmt.Errorf("failed to find Session for client %s", clientKey)
@@ -36,70 +173,200 @@ func (sm *sessionManager) getDialer(clientKey string) (Dialer, error) {
 
 	cs := value.(*clientSessions)
 	cs.mu.Lock()
-	sessionsLen := len(cs.sessions)
+	candidates := make([]Candidate, 0, len(cs.sessions))
+	for _, s := range cs.sessions {
+		if exclude[s.session] || s.session.Context().Err() != nil {
+			continue
+		}
+		candidates = append(candidates, s)
+	}
+	cs.mu.Unlock()
 
-	if sessionsLen == 0 {
-		cs.mu.Unlock()
+	if len(candidates) == 0 {
 		return nil, fmt.Errorf("client %s has no active sessions", clientKey)
 	}
 
-	// 使用简单的随机选择来实现负载均衡
-	selectedIndex := rand.Intn(sessionsLen)
-	selectedSession := cs.sessions[selectedIndex]
-	cs.mu.Unlock()
+	return pickCandidate(sm.balancerFor(clientKey), clientKey, candidates)
+}
+
+// pickCandidate 使用 b 在 candidates 中选择会话，按 ID 将返回值映射回候选会话。
+// 自定义的负载均衡策略可能包装候选会话或返回 nil，返回值不对应任何候选会话时返回错误
+func pickCandidate(b Balancer, key string, candidates []Candidate) (*serverSession, error) {
+	picked := b.Pick(key, candidates)
+	if picked == nil {
+		return nil, fmt.Errorf("balancer picked no session for %s", key)
+	}
+	id := picked.ID()
+	for _, c := range candidates {
+		if c.ID() == id {
+			return c.(*serverSession), nil
+		}
+	}
+	return nil, fmt.Errorf("balancer picked unknown session %d for %s", id, key)
+}
 
-	// 使用选中的会话创建拨号器
-	return toDialer(selectedSession, ""), nil
+// balancerFor 返回 clientKey 使用的负载均衡策略
+func (sm *sessionManager) balancerFor(clientKey string) Balancer {
+	if b, ok := sm.balancers.Load(clientKey); ok {
+		return b.(Balancer)
+	}
+	return sm.balancer
 }
 
-func (sm *sessionManager) add(clientKey string, session *webtransport.Session) *webtransport.Session {
-	// 获取或创建客户端会话列表
-	value, _ := sm.clients.LoadOrStore(clientKey, &clientSessions{
-		sessions: []*webtransport.Session{},
-	})
+// setBalancer 覆盖 clientKey 的负载均衡策略，b 为 nil 时恢复默认策略
+func (sm *sessionManager) setBalancer(clientKey string, b Balancer) {
+	if b == nil {
+		sm.balancers.Delete(clientKey)
+		return
+	}
+	sm.balancers.Store(clientKey, b)
+}
 
+// admit 在升级会话之前检查准入策略，使被拒绝的客户端能收到 HTTP 错误
+func (sm *sessionManager) admit(clientKey, instanceID string) error {
+	value, ok := sm.clients.Load(clientKey)
+	if !ok {
+		return nil
+	}
 	cs := value.(*clientSessions)
 	cs.mu.Lock()
-	cs.sessions = append(cs.sessions, session)
-	cs.mu.Unlock()
+	defer cs.mu.Unlock()
+	_, err := sm.checkPolicy(cs, clientKey, instanceID)
+	return err
+}
+
+// checkPolicy 返回接纳新会话需要关闭的旧会话，调用方需持有 cs.mu
+func (sm *sessionManager) checkPolicy(cs *clientSessions, clientKey, instanceID string) ([]*serverSession, error) {
+	maxSessions := sm.maxSessionsFor(clientKey)
+	var stale []*serverSession
+	remaining := len(cs.sessions)
+	if instanceID != "" {
+		// 同一客户端实例的同一槽位重连，旧会话已失效
+		for _, s := range cs.sessions {
+			if s.instanceID == instanceID {
+				stale = append(stale, s)
+			}
+		}
+		remaining -= len(stale)
+	}
 
-	return session
+	switch sm.policy.Duplicate {
+	case DuplicateReject:
+		if remaining > 0 {
+			return nil, errDuplicateClient
+		}
+	case DuplicateReplaceOldest:
+		if maxSessions > 0 {
+			for _, s := range cs.sessions {
+				if remaining < maxSessions {
+					break
+				}
+				if s.instanceID != instanceID || instanceID == "" {
+					stale = append(stale, s)
+					remaining--
+				}
+			}
+		}
+	default:
+		if maxSessions > 0 && remaining >= maxSessions {
+			return nil, errTooManySessions
+		}
+	}
+	return stale, nil
 }
 
-func (sm *sessionManager) remove(clientKey string, session *webtransport.Session) {
-	value, ok := sm.clients.Load(clientKey)
+// add 按准入策略登记会话并分配会话 ID，返回错误时会话未被登记
+func (sm *sessionManager) add(ss *serverSession) error {
+	ss.id = sm.nextID.Add(1)
+	ss.connectedAt = time.Now()
+	clientKey, instanceID := ss.clientKey, ss.instanceID
+
+	for {
+		// 获取或创建客户端会话列表
+		value, _ := sm.clients.LoadOrStore(clientKey, &clientSessions{
+			sessions: []*serverSession{},
+		})
+
+		cs := value.(*clientSessions)
+		cs.mu.Lock()
+		if current, ok := sm.clients.Load(clientKey); !ok || current != cs {
+			// 列表在加锁前已被 remove 删除，重新获取
+			cs.mu.Unlock()
+			continue
+		}
+		stale, err := sm.checkPolicy(cs, clientKey, instanceID)
+		if err != nil {
+			cs.mu.Unlock()
+			return err
+		}
+		for _, s := range stale {
+			cs.sessions = deleteSession(cs.sessions, s)
+		}
+		ss.quota = sm.acquireQuota(clientKey)
+		ss.stats.shaping.client = ss.quota.bytes
+		cs.sessions = append(cs.sessions, ss)
+		cs.mu.Unlock()
+
+		for _, s := range stale {
+			_ = s.session.CloseWithError(CodeReplaced, "replaced by new session")
+		}
+		if sm.listener != nil {
+			sm.listener.sessionAdded(clientKey, ss.id)
+		}
+		return nil
+	}
+}
+
+func (sm *sessionManager) remove(ss *serverSession) {
+	defer sm.releaseQuota(ss.clientKey, ss.quota)
+	value, ok := sm.clients.Load(ss.clientKey)
 	if !ok {
 		return
 	}
 
 	cs := value.(*clientSessions)
 	cs.mu.Lock()
-
-	for i, s := range cs.sessions {
-		if s == session {
-			cs.sessions = append(cs.sessions[:i], cs.sessions[i+1:]...)
-			break
-		} else {
-			_ = s.CloseWithError(0, "服务器关闭")
-		}
+	cs.sessions = deleteSession(cs.sessions, ss)
+	if len(cs.sessions) == 0 {
+		sm.clients.CompareAndDelete(ss.clientKey, cs)
 	}
-
-	isEmpty := len(cs.sessions) == 0
 	cs.mu.Unlock()
 
-	if isEmpty {
-		sm.clients.Delete(clientKey)
+	if sm.listener != nil {
+		sm.listener.sessionRemoved(ss.clientKey, ss.id)
+	}
+}
+
+// closeClient 以 code 和 reason 关闭 clientKey 的全部会话，返回关闭的会话数
+func (sm *sessionManager) closeClient(clientKey string, code webtransport.SessionErrorCode, reason string) int {
+	sessions := sm.sessionsOf(clientKey)
+	for _, ss := range sessions {
+		_ = ss.session.CloseWithError(code, reason)
 	}
+	return len(sessions)
 }
 
 func (sm *sessionManager) removeAll() {
 
 	sm.clients.Range(func(key, value interface{}) bool {
 		cs := value.(*clientSessions)
-		for _, s := range cs.sessions {
-			_ = s.CloseWithError(0, "服务器关闭")
+		cs.mu.Lock()
+		sessions := cs.sessions
+		cs.sessions = nil
+		cs.mu.Unlock()
+		for _, s := range sessions {
+			_ = s.session.CloseWithError(CodeShutdown, "服务器关闭")
 		}
 		return true
 	})
 	sm.clients.Clear()
 }
+
+func deleteSession(sessions []*serverSession, ss *serverSession) []*serverSession {
+	for i, s := range sessions {
+		if s == ss {
+			return append(sessions[:i], sessions[i+1:]...)
+		}
+	}
+	return sessions
+}
@@ -0,0 +1,56 @@
+package rdialer
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestCheckPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    SessionPolicy
+		limits    ClientLimits // clientKey 的限制覆盖
+		existing  []string     // 已有会话的 instanceID，按建立顺序排列
+		instance  string       // 新会话的 instanceID
+		wantStale []int        // 需要关闭的已有会话下标
+		wantErr   error
+	}{
+		{name: "allow unlimited", policy: SessionPolicy{}, existing: []string{"a", "b"}, instance: "c"},
+		{name: "allow under limit", policy: SessionPolicy{MaxSessions: 3}, existing: []string{"a", "b"}, instance: "c"},
+		{name: "allow at limit", policy: SessionPolicy{MaxSessions: 2}, existing: []string{"a", "b"}, instance: "c", wantErr: errTooManySessions},
+		{name: "allow same instance replaces", policy: SessionPolicy{MaxSessions: 2}, existing: []string{"a", "b"}, instance: "b", wantStale: []int{1}},
+		{name: "allow limit override", policy: SessionPolicy{MaxSessions: 2}, limits: ClientLimits{MaxSessions: 3}, existing: []string{"a", "b"}, instance: "c"},
+		{name: "allow without instance", policy: SessionPolicy{MaxSessions: 1}, existing: []string{""}, instance: "", wantErr: errTooManySessions},
+		{name: "reject first session", policy: SessionPolicy{Duplicate: DuplicateReject}, instance: "a"},
+		{name: "reject duplicate", policy: SessionPolicy{Duplicate: DuplicateReject}, existing: []string{"a"}, instance: "b", wantErr: errDuplicateClient},
+		{name: "reject same instance replaces", policy: SessionPolicy{Duplicate: DuplicateReject}, existing: []string{"a"}, instance: "a", wantStale: []int{0}},
+		{name: "replace oldest", policy: SessionPolicy{Duplicate: DuplicateReplaceOldest, MaxSessions: 2}, existing: []string{"a", "b"}, instance: "c", wantStale: []int{0}},
+		{name: "replace two oldest", policy: SessionPolicy{Duplicate: DuplicateReplaceOldest, MaxSessions: 1}, existing: []string{"a", "b"}, instance: "c", wantStale: []int{0, 1}},
+		{name: "replace same instance only", policy: SessionPolicy{Duplicate: DuplicateReplaceOldest, MaxSessions: 2}, existing: []string{"a", "b"}, instance: "b", wantStale: []int{1}},
+		{name: "replace unlimited", policy: SessionPolicy{Duplicate: DuplicateReplaceOldest}, existing: []string{"a", "b"}, instance: "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newSessionManager()
+			sm.policy = tt.policy
+			sm.setLimits("k", tt.limits)
+			cs := &clientSessions{}
+			for _, instance := range tt.existing {
+				cs.sessions = append(cs.sessions, &serverSession{clientKey: "k", instanceID: instance})
+			}
+			stale, err := sm.checkPolicy(cs, "k", tt.instance)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			var got []int
+			for _, s := range stale {
+				got = append(got, slices.Index(cs.sessions, s))
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.wantStale) {
+				t.Fatalf("stale = %v, want %v", got, tt.wantStale)
+			}
+		})
+	}
+}
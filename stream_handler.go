@@ -2,31 +2,51 @@ package rdialer
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"github.com/rs/zerolog/log"
 	"io"
 	"net"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/midy177/webtransport-go"
 )
 
-// handleStream 处理单个流
-func handleStream(stream webtransport.Stream, remoteAddr, localAddr net.Addr) {
+// streamAdmitter 决定是否接受隧道连接，接受时返回处理结束后归还名额的函数，拒绝时负责重置流
+type streamAdmitter func(stream webtransport.Stream) (release func(), ok bool)
+
+// handleStream 处理单个流，timeouts 是本端配置的隧道超时，
+// 只有隧道连接经过 admit，控制通道和保活等流不受限流和并发上限影响
+func handleStream(stream webtransport.Stream, remoteAddr, localAddr net.Addr, stats *streamStats, timeouts TunnelTimeouts, handlers map[MessageType]messageHandler, admit streamAdmitter) {
 	defer stream.Close()
 
 	// 创建解码缓冲区
 	decodeBuffer := NewDecodeBuffer()
 	// 读取消息
 	n, err := decodeBuffer.ReadFrom(stream)
+	if err == io.EOF {
+		// 乐观拨号的连接在发送任何数据前关闭时，流中没有消息
+		log.Debug().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Msg("stream closed without message")
+		return
+	}
 	if err != nil {
 		log.Error().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Err(err).Msg("read from stream")
 		return
 	}
 
+	if handler, ok := handlers[decodeBuffer.MessageType]; ok {
+		handler(stream, decodeBuffer.Buffer)
+		return
+	}
+	if t := decodeBuffer.MessageType; t == Connect || t == ConnectEx {
+		release, ok := admit(stream)
+		if !ok {
+			return
+		}
+		defer release()
+	}
 	switch decodeBuffer.MessageType {
 	case KeepAlive:
 		doKeepalive(stream, remoteAddr, localAddr)
@@ -36,19 +56,35 @@ func handleStream(stream webtransport.Stream, remoteAddr, localAddr net.Addr) {
 			log.Error().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Msg("connect proto address error")
 			return
 		}
-		conn, err := newConnection(stream, str[0], str[1])
-		if err != nil {
-			log.Error().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Err(err).Msg("new connection")
+		acceptTunnel(stream, remoteAddr, localAddr, stats, str[0], str[1], timeouts, false)
+	case ConnectEx:
+		var req connectRequest
+		if err := json.Unmarshal(decodeBuffer.Buffer, &req); err != nil {
+			log.Error().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Err(err).Msg("decode connect")
 			return
 		}
-		log.Debug().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Msgf("proto: %s address: %s", str[0], str[1])
-		doDial(context.TODO(), conn, str[0], str[1])
+		acceptTunnel(stream, remoteAddr, localAddr, stats, req.Proto, req.Address, req.Timeouts.or(timeouts), req.Early)
 	default:
 		log.Error().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).
 			Str("Type", strconv.FormatInt(int64(decodeBuffer.MessageType), 10)).Msg("Unsupported message type")
 	}
 }
 
+// acceptTunnel 将对端打开的流包装为隧道连接并拨号目标地址，report 为 true 时在转发数据前向对端回复拨号结果
+func acceptTunnel(stream webtransport.Stream, remoteAddr, localAddr net.Addr, stats *streamStats, proto, address string, timeouts TunnelTimeouts, report bool) {
+	conn, err := newConnection(stream, proto, address, stats)
+	if err != nil {
+		log.Error().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Err(err).Msg("new connection")
+		return
+	}
+	conn.accepted = true
+	if stats != nil {
+		stats.track(conn)
+	}
+	log.Debug().Str("LocalAddr", localAddr.String()).Str("RemoteAddr", remoteAddr.String()).Msgf("proto: %s address: %s", proto, address)
+	doDial(context.TODO(), conn, proto, address, timeouts, report)
+}
+
 func doKeepalive(stream webtransport.Stream, remoteAddr, localAddr net.Addr) {
 	streamID := stream.StreamID()
 	keepMsg := make([]byte, 1)
@@ -76,7 +112,7 @@ var DialHijack Hijacker = func(ctx context.Context, conn net.Conn, proto, addres
 	return true
 }
 
-func doDial(ctx context.Context, conn net.Conn, proto, address string) {
+func doDial(ctx context.Context, conn *connection, proto, address string, timeouts TunnelTimeouts, report bool) {
 	// Do client hijacker
 	if !DialHijack(ctx, conn, proto, address) {
 		_ = conn.Close()
@@ -89,6 +125,13 @@ func doDial(ctx context.Context, conn net.Conn, proto, address string) {
 
 	d := net.Dialer{}
 	netConn, err := d.DialContext(ctx, proto, address)
+	if report {
+		// 拨号结果先于数据发送，拨号端在首次读取时得到结果
+		if rerr := sendConnectResult(conn.stream, err); rerr != nil && err == nil {
+			_ = netConn.Close()
+			return
+		}
+	}
 
 	if err != nil {
 		_ = conn.Close()
@@ -98,56 +141,70 @@ func doDial(ctx context.Context, conn net.Conn, proto, address string) {
 		_ = netConn.Close()
 	}(netConn)
 
-	pipe(conn, netConn)
+	reason := pipe(conn, netConn, timeouts)
+	conn.recordClose(reason)
 }
 
-func pipe(client net.Conn, server net.Conn) {
-	ch := make(chan error, 2)
-	done := make(chan struct{})
-	closeOnce := sync.Once{}
-
-	redirect := func(dst net.Conn, src net.Conn) {
-		timeout := 30 * time.Second
-		for {
-			select {
-			case <-done:
-				ch <- nil
+// closeReason 是隧道连接关闭的原因
+type closeReason string
+
+const (
+	closeNormal   closeReason = "normal"   // 任意一端关闭连接
+	closeError    closeReason = "error"    // 数据传输出错
+	closeIdle     closeReason = "idle"     // 空闲超时
+	closeLifetime closeReason = "lifetime" // 达到最长存活时间
+)
+
+// pipe 在两个连接之间双向转发数据，直到任意一端关闭、出错或触发超时，返回关闭原因。
+// 一个方向在当前协程中转发，另一个方向使用一个新协程，client 为 *connection 时按其缓冲预算限制已读取尚未写出的字节数；
+// 超时由定时器回调处理，不在每次读写时设置截止时间
+func pipe(client, server net.Conn, timeouts TunnelTimeouts) closeReason {
+	p := &pipeState{client: client, server: server}
+	p.touch()
+
+	if idle := timeouts.idle(); idle > 0 {
+		var idleTimer *time.Timer
+		idleTimer = time.AfterFunc(idle, func() {
+			// 按最近一次数据传输的时间重新计算剩余的空闲时长
+			if remaining := idle - time.Since(time.Unix(0, p.lastActive.Load())); remaining > 0 {
+				idleTimer.Reset(remaining)
 				return
-			default:
-				_ = src.SetReadDeadline(time.Now().Add(timeout))
-				_ = dst.SetWriteDeadline(time.Now().Add(timeout))
-				_, err := io.CopyN(dst, src, 32*1024)
-				if err != nil {
-					closeOnce.Do(func() { close(done) })
-					if isNormalNetError(err) || isTimeout(err) {
-						ch <- nil // 正常关闭
-						return
-					}
-					ch <- err // 异常关闭
-					return
-				}
 			}
-		}
+			p.terminate(closeIdle)
+		})
+		defer idleTimer.Stop()
+	}
+	if lifetime := timeouts.lifetime(); lifetime > 0 {
+		lifetimeTimer := time.AfterFunc(lifetime, func() {
+			p.terminate(closeLifetime)
+		})
+		defer lifetimeTimer.Stop()
 	}
 
-	// 启动两个方向的数据复制
-	go redirect(server, client)
-	go redirect(client, server)
-
-	// 等待两个方向都完成
-	err1, err2 := <-ch, <-ch
-
-	// 关闭连接
-	_ = client.Close()
-	_ = server.Close()
-
-	// 只记录非超时、非EOF的错误
-	if err1 != nil {
-		log.Printf("pipe error: %v", err1)
+	redirect := func(dst net.Conn, src net.Conn, bp *streamBackPressure) {
+		_, err := copyBuffer(&activityWriter{w: dst, p: p}, src, bp)
+		// 只有先结束的方向反映关闭原因，另一方向的错误由关闭连接导致
+		if err != nil && !isNormalNetError(err) {
+			if p.terminate(closeError) {
+				log.Debug().Err(err).Msg("pipe error")
+			}
+			return
+		}
+		p.terminate(closeNormal)
 	}
-	if err2 != nil {
-		log.Printf("pipe error: %v", err2)
+
+	var inBudget, outBudget *streamBackPressure
+	if conn, ok := client.(*connection); ok {
+		inBudget, outBudget = conn.inBudget, conn.outBudget
 	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		redirect(server, client, inBudget)
+	}()
+	redirect(client, server, outBudget)
+	<-done
+	return p.reason
 }
 
 // 判断是否为超时错误
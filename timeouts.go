@@ -0,0 +1,77 @@
+package rdialer
+
+import (
+	"context"
+	"time"
+)
+
+// NoTimeout 用于 TunnelTimeouts 的字段，表示不限制
+const NoTimeout time.Duration = -1
+
+// DefaultIdleTimeout 是未配置空闲超时时隧道连接的空闲超时
+var DefaultIdleTimeout = 30 * time.Second
+
+// tunnelOptionsVersion 是支持在拨号时携带隧道超时设置的最低协议版本
+const tunnelOptionsVersion = 5
+
+// TunnelTimeouts 是隧道连接的超时设置，由负责拨号目标地址并转发数据的一端执行。
+// 字段为 0 表示未设置，依次回退到本端配置和默认值，NoTimeout 表示不限制。
+type TunnelTimeouts struct {
+	// IdleTimeout 两个方向都没有数据传输超过该时长后关闭连接
+	IdleTimeout time.Duration `json:"idleTimeout,omitempty"`
+	// MaxLifetime 连接建立后的最长存活时间，未设置时不限制
+	MaxLifetime time.Duration `json:"maxLifetime,omitempty"`
+}
+
+// or 用 fallback 填充未设置的字段
+func (t TunnelTimeouts) or(fallback TunnelTimeouts) TunnelTimeouts {
+	if t.IdleTimeout == 0 {
+		t.IdleTimeout = fallback.IdleTimeout
+	}
+	if t.MaxLifetime == 0 {
+		t.MaxLifetime = fallback.MaxLifetime
+	}
+	return t
+}
+
+// idle 返回生效的空闲超时，不限制时返回 0
+func (t TunnelTimeouts) idle() time.Duration {
+	switch {
+	case t.IdleTimeout == 0:
+		return DefaultIdleTimeout
+	case t.IdleTimeout < 0:
+		return 0
+	}
+	return t.IdleTimeout
+}
+
+// lifetime 返回生效的最长存活时间，不限制时返回 0
+func (t TunnelTimeouts) lifetime() time.Duration {
+	return max(t.MaxLifetime, 0)
+}
+
+type tunnelTimeoutsCtxKey struct{}
+
+// WithDialTimeouts 为单次拨号设置隧道超时，覆盖拨号端和对端的配置，对端协议版本不支持时由对端使用自身配置
+func WithDialTimeouts(ctx context.Context, timeouts TunnelTimeouts) context.Context {
+	return context.WithValue(ctx, tunnelTimeoutsCtxKey{}, timeouts)
+}
+
+func dialTimeoutsFrom(ctx context.Context) TunnelTimeouts {
+	timeouts, _ := ctx.Value(tunnelTimeoutsCtxKey{}).(TunnelTimeouts)
+	return timeouts
+}
+
+// WithTunnelTimeouts 设置服务端隧道连接的超时，作用于服务端转发数据的连接和服务端发起的拨号
+func WithTunnelTimeouts(timeouts TunnelTimeouts) ServerOption {
+	return func(s *Server) {
+		s.sessions.timeouts = timeouts
+	}
+}
+
+// WithClientTunnelTimeouts 设置客户端隧道连接的超时，作用于客户端转发数据的连接和客户端发起的拨号
+func WithClientTunnelTimeouts(timeouts TunnelTimeouts) ClientOption {
+	return func(c *Client) {
+		c.timeouts = timeouts
+	}
+}